@@ -0,0 +1,190 @@
+package classify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go-strava-daemon/stravaclient"
+)
+
+// Actions of a rule
+const (
+	Accept = "accept"
+	Reject = "reject"
+)
+
+// Rule : Conditions an activity has to meet for the rule to apply, empty conditions match every activity
+type Rule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+
+	// Types & WorkoutTypes : Allowed Strava activity types and workout types
+	Types        []string `json:"types,omitempty"`
+	WorkoutTypes []int    `json:"workout_types,omitempty"`
+	Commute      *bool    `json:"commute,omitempty"`
+	Trainer      *bool    `json:"trainer,omitempty"`
+	Manual       *bool    `json:"manual,omitempty"`
+	// MinDistance & MaxDistance : Bounds of the distance in meters, ignored when 0
+	MinDistance float64 `json:"min_distance,omitempty"`
+	MaxDistance float64 `json:"max_distance,omitempty"`
+	// MinDuration & MaxDuration : Bounds of the moving time in seconds, ignored when 0
+	MinDuration int `json:"min_duration,omitempty"`
+	MaxDuration int `json:"max_duration,omitempty"`
+	// MinSpeed & MaxSpeed : Bounds of the average moving speed in km/h, ignored when 0
+	MinSpeed float64 `json:"min_speed,omitempty"`
+	MaxSpeed float64 `json:"max_speed,omitempty"`
+}
+
+// Rules : Ordered list of rules, the first matching rule decides
+type Rules struct {
+	Rules []Rule `json:"rules"`
+	// Default : Action when no rule matches, Reject when empty
+	Default string `json:"default,omitempty"`
+}
+
+// Decision : Outcome of classifying an activity
+type Decision struct {
+	Accepted bool
+	// Rule : Name of the rule that matched, "default" when none did
+	Rule string
+}
+
+// Reason : Describe the decision
+func (d Decision) Reason() string {
+	if d.Rule == "default" {
+		return "no rule matched"
+	}
+	return fmt.Sprintf("rule %v", d.Rule)
+}
+
+// truePtr & falsePtr : Helpers for the default rules
+var (
+	truePtr  = func() *bool { b := true; return &b }()
+	falsePtr = func() *bool { b := false; return &b }()
+)
+
+// DefaultRules : Rules used when no rules file is configured
+func DefaultRules() *Rules {
+	return &Rules{
+		Rules: []Rule{
+			{Name: "trainer", Action: Reject, Trainer: truePtr},
+			{Name: "manual", Action: Reject, Manual: truePtr},
+			{Name: "virtual", Action: Reject, Types: []string{"VirtualRide"}},
+			{Name: "motorized", Action: Reject, MinSpeed: 45},
+			{Name: "cycling", Action: Accept, Types: []string{"Ride", "EBikeRide", "GravelRide", "MountainBikeRide", "Handcycle", "Velomobile"}, Trainer: falsePtr},
+		},
+		Default: Reject,
+	}
+}
+
+// Load : Read rules from a JSON file
+func Load(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read classification rules: %v", err)
+	}
+	rules := &Rules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("Could not parse classification rules: %v", err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Validate : Check the actions and names of the rules
+func (r *Rules) Validate() error {
+	if r.Default != "" && r.Default != Accept && r.Default != Reject {
+		return fmt.Errorf("Unknown default action %v, use %v or %v", r.Default, Accept, Reject)
+	}
+	for i, rule := range r.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("Classification rule %v has no name", i)
+		}
+		if rule.Action != Accept && rule.Action != Reject {
+			return fmt.Errorf("Unknown action %v in classification rule %v, use %v or %v", rule.Action, rule.Name, Accept, Reject)
+		}
+	}
+	return nil
+}
+
+// Classify : Decide whether an activity is kept, using the first matching rule
+func (r *Rules) Classify(activity *stravaclient.Activity) Decision {
+	for _, rule := range r.Rules {
+		if rule.Matches(activity) {
+			return Decision{Accepted: rule.Action == Accept, Rule: rule.Name}
+		}
+	}
+	return Decision{Accepted: r.Default == Accept, Rule: "default"}
+}
+
+// Matches : Check if an activity meets all conditions of the rule
+func (rule *Rule) Matches(activity *stravaclient.Activity) bool {
+	if len(rule.Types) > 0 && !containsType(rule.Types, activity.Type) {
+		return false
+	}
+	if len(rule.WorkoutTypes) > 0 && !containsInt(rule.WorkoutTypes, activity.WorkoutType) {
+		return false
+	}
+	if rule.Commute != nil && *rule.Commute != activity.Commute {
+		return false
+	}
+	if rule.Trainer != nil && *rule.Trainer != activity.Trainer {
+		return false
+	}
+	if rule.Manual != nil && *rule.Manual != activity.Manual {
+		return false
+	}
+
+	distance := float64(activity.Distance)
+	if rule.MinDistance > 0 && distance < rule.MinDistance {
+		return false
+	}
+	if rule.MaxDistance > 0 && distance > rule.MaxDistance {
+		return false
+	}
+	if rule.MinDuration > 0 && activity.MovingTime < rule.MinDuration {
+		return false
+	}
+	if rule.MaxDuration > 0 && activity.MovingTime > rule.MaxDuration {
+		return false
+	}
+
+	if rule.MinSpeed > 0 || rule.MaxSpeed > 0 {
+		// Activities without moving time have no meaningful speed
+		if activity.MovingTime <= 0 {
+			return false
+		}
+		speed := distance / float64(activity.MovingTime) * 3.6
+		if rule.MinSpeed > 0 && speed < rule.MinSpeed {
+			return false
+		}
+		if rule.MaxSpeed > 0 && speed > rule.MaxSpeed {
+			return false
+		}
+	}
+	return true
+}
+
+// containsType : Check if the list contains the activity type, ignoring case
+func containsType(types []string, activityType string) bool {
+	for _, t := range types {
+		if strings.EqualFold(t, activityType) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt : Check if the list contains the value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package classify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-strava-daemon/stravaclient"
+)
+
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		activity stravaclient.Activity
+		accepted bool
+		rule     string
+	}{
+		{"ride", stravaclient.Activity{Type: "Ride", Distance: 10000, MovingTime: 1800}, true, "cycling"},
+		{"type ignores case", stravaclient.Activity{Type: "ebikeride", Distance: 10000, MovingTime: 1800}, true, "cycling"},
+		{"trainer", stravaclient.Activity{Type: "Ride", Trainer: true, Distance: 10000, MovingTime: 1800}, false, "trainer"},
+		{"manual", stravaclient.Activity{Type: "Ride", Manual: true, Distance: 10000, MovingTime: 1800}, false, "manual"},
+		{"virtual", stravaclient.Activity{Type: "VirtualRide", Distance: 10000, MovingTime: 1800}, false, "virtual"},
+		// 50 km in an hour
+		{"motorized", stravaclient.Activity{Type: "Ride", Distance: 50000, MovingTime: 3600}, false, "motorized"},
+		// The bounds are inclusive
+		{"at the speed limit", stravaclient.Activity{Type: "Ride", Distance: 45000, MovingTime: 3600}, false, "motorized"},
+		{"below the speed limit", stravaclient.Activity{Type: "Ride", Distance: 44000, MovingTime: 3600}, true, "cycling"},
+		// Without moving time there is no speed to compare
+		{"no moving time", stravaclient.Activity{Type: "Ride", Distance: 50000}, true, "cycling"},
+		{"run", stravaclient.Activity{Type: "Run", Distance: 10000, MovingTime: 3600}, false, "default"},
+	}
+	rules := DefaultRules()
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := rules.Classify(&test.activity)
+			if decision.Accepted != test.accepted || decision.Rule != test.rule {
+				t.Errorf("got accepted=%v rule=%v, want accepted=%v rule=%v", decision.Accepted, decision.Rule, test.accepted, test.rule)
+			}
+		})
+	}
+}
+
+func TestRuleBounds(t *testing.T) {
+	rule := Rule{Name: "bounded", Action: Accept, MinDistance: 1000, MaxDistance: 5000, MinDuration: 60, MaxDuration: 600, WorkoutTypes: []int{10, 12}}
+	tests := []struct {
+		name     string
+		activity stravaclient.Activity
+		matches  bool
+	}{
+		{"within bounds", stravaclient.Activity{Distance: 3000, MovingTime: 300, WorkoutType: 10}, true},
+		{"on the bounds", stravaclient.Activity{Distance: 1000, MovingTime: 600, WorkoutType: 12}, true},
+		{"too short", stravaclient.Activity{Distance: 999, MovingTime: 300, WorkoutType: 10}, false},
+		{"too long", stravaclient.Activity{Distance: 5001, MovingTime: 300, WorkoutType: 10}, false},
+		{"too quick", stravaclient.Activity{Distance: 3000, MovingTime: 59, WorkoutType: 10}, false},
+		{"too slow", stravaclient.Activity{Distance: 3000, MovingTime: 601, WorkoutType: 10}, false},
+		{"other workout type", stravaclient.Activity{Distance: 3000, MovingTime: 300, WorkoutType: 11}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rule.Matches(&test.activity); got != test.matches {
+				t.Errorf("got %v, want %v", got, test.matches)
+			}
+		})
+	}
+}
+
+func TestRulesDefault(t *testing.T) {
+	activity := &stravaclient.Activity{Type: "Run"}
+	tests := []struct {
+		rules    Rules
+		accepted bool
+	}{
+		{Rules{}, false},
+		{Rules{Default: Reject}, false},
+		{Rules{Default: Accept}, true},
+	}
+	for _, test := range tests {
+		if decision := test.rules.Classify(activity); decision.Accepted != test.accepted || decision.Reason() != "no rule matched" {
+			t.Errorf("default %q: got %+v, want accepted=%v", test.rules.Default, decision, test.accepted)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	rules, err := Load("rules.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commute := &stravaclient.Activity{Type: "Ride", Commute: true, Distance: 3000, MovingTime: 600}
+	if decision := rules.Classify(commute); !decision.Accepted || decision.Reason() != "rule commute" {
+		t.Errorf("got %+v, want the commute rule", decision)
+	}
+	short := &stravaclient.Activity{Type: "Ride", Distance: 400, MovingTime: 120}
+	if decision := rules.Classify(short); decision.Accepted || decision.Rule != "too-short" {
+		t.Errorf("got %+v, want the too-short rule", decision)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"invalid json":    `{"rules": [`,
+		"unknown action":  `{"rules": [{"name": "a", "action": "keep"}]}`,
+		"missing name":    `{"rules": [{"action": "accept"}]}`,
+		"unknown default": `{"rules": [], "default": "keep"}`,
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, "rules.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("%v: loaded without error", name)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file: loaded without error")
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	"go-strava-daemon/config"
+	"go-strava-daemon/queue"
+)
+
+// commandUsage : Help text of the operator commands
+const commandUsage = `Usage: go-strava-daemon [command]
+
+Without a command the daemon is started. The commands read the same CONFIG_* environment variables.
+
+Commands:
+  subscriptions list                 List the webhook subscriptions of the application
+  subscriptions status               Show the subscription stored for CONFIG_CALLBACKURL without calling Strava
+  subscriptions create               Subscribe CONFIG_CALLBACKURL, Strava validates it with CONFIG_STRAVAVERIFYTOKEN or the stored token
+  subscriptions delete [-id ID]      Delete one subscription, or all of them without -id
+  backfill -user ATHLETE [-restart]  Fetch the history of one user, from the newest activity again with -restart
+  refresh-token -user ATHLETE        Refresh the access token of one user
+  cache ls                           List the pending queue entries and the dead letters
+  cache replay [-all | NAME...]      Move dead letters back to the queue
+  cache purge [-all | NAME...]       Delete dead letters
+  config check                       Validate the configuration
+`
+
+// errUsage : Returned by commands called with invalid arguments
+var errUsage = errors.New("Invalid arguments")
+
+// runCommand : Run an operator command and return the exit code of the process
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "subscriptions":
+		err = subscriptionsCommand(args[1:])
+	case "backfill":
+		err = backfillCommand(args[1:])
+	case "refresh-token":
+		err = refreshTokenCommand(args[1:])
+	case "cache":
+		err = cacheCommand(args[1:])
+	case "config":
+		err = configCommand(args[1:])
+	case "help":
+		fmt.Print(commandUsage)
+		return 0
+	default:
+		err = errUsage
+	}
+
+	if err == errUsage || err == flag.ErrHelp {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseFlags : Parse the flags of a command, the remaining arguments are returned
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	return flags.Args(), nil
+}
+
+// commandConfig : Load and check the configuration for a command
+func commandConfig() (*config.Config, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := configure(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// subscriptionsCommand : Manage the webhook subscriptions of the application
+func subscriptionsCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("subscriptions "+args[0], flag.ContinueOnError)
+	id := flags.Int("id", 0, "")
+	if rest, err := parseFlags(flags, args[1:]); err != nil || len(rest) > 0 {
+		return errUsage
+	}
+
+	conf, err := commandConfig()
+	if err != nil {
+		return err
+	}
+	if err := openStorage(conf, connectStrava(conf)); err != nil {
+		return err
+	}
+	stored, err := db.GetSubscription(conf.CallbackURL)
+	if err != nil {
+		return fmt.Errorf("Could not get the stored subscription: %v", err)
+	}
+
+	switch args[0] {
+	case "list":
+		subscriptions, err := out.Client.ListSubscriptions(context.Background())
+		if err != nil {
+			return fmt.Errorf("Could not get active subscriptions: %v", err)
+		}
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tCALLBACK URL\tCREATED AT")
+		for _, subscription := range subscriptions {
+			fmt.Fprintf(table, "%v\t%v\t%v\n", subscription.ID, subscription.CallbackURL, subscription.CreatedAt)
+		}
+		return table.Flush()
+	case "status":
+		if stored.VerifyToken == "" {
+			fmt.Printf("No subscription stored for %v\n", conf.CallbackURL)
+			return nil
+		}
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(table, "Callback URL\t%v\n", stored.CallbackURL)
+		fmt.Fprintf(table, "Subscription ID\t%v\n", stored.ID)
+		fmt.Fprintf(table, "Verify token\t%v\n", stored.VerifyToken)
+		fmt.Fprintf(table, "Updated at\t%v\n", stored.UpdatedAt.Format(time.RFC3339))
+		return table.Flush()
+	case "create":
+		if conf.StravaVerifyToken == "" {
+			if stored.VerifyToken == "" {
+				return fmt.Errorf("Set CONFIG_STRAVAVERIFYTOKEN to the verify token of the daemon answering %v", conf.CallbackURL)
+			}
+			out.VerifyToken = stored.VerifyToken
+		}
+		subscription, err := out.CreateSubscription(context.Background())
+		if err != nil {
+			return err
+		}
+		if err := saveSubscription(); err != nil {
+			return fmt.Errorf("Could not save the subscription: %v", err)
+		}
+		fmt.Printf("Created subscription %v for %v\n", subscription.ID, conf.CallbackURL)
+	case "delete":
+		if conf.DryRun {
+			return fmt.Errorf("Strava subscriptions cannot be changed during a dry run")
+		}
+		if *id == 0 {
+			err = out.UnsubscribeFromStrava(context.Background())
+		} else if err = out.Client.DeleteSubscription(context.Background(), *id); err != nil {
+			err = fmt.Errorf("Could not unsubscribe from ID %v: %v", *id, err)
+		} else {
+			fmt.Printf("Deleted subscription %v\n", *id)
+		}
+		if err != nil {
+			return err
+		}
+		// The daemons keep their verify token, they subscribe again on their next check
+		if stored.ID != 0 && (*id == 0 || *id == stored.ID) {
+			stored.ID = 0
+			if err := db.SaveSubscription(stored); err != nil {
+				return fmt.Errorf("Could not save the subscription: %v", err)
+			}
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// commandUser : Connect to Strava & the storage and get a user by their Strava athlete ID
+func commandUser(conf *config.Config, athlete string) (user dbmodel.User, err error) {
+	if err = openStorage(conf, connectStrava(conf)); err != nil {
+		return
+	}
+	user, err = db.GetUserData(athlete)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("Unknown user %v", athlete)
+	} else if err != nil {
+		err = fmt.Errorf("Could not get user %v: %v", athlete, err)
+	}
+	return
+}
+
+// backfillCommand : Fetch the history of one user
+func backfillCommand(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	athlete := flags.String("user", "", "")
+	restart := flags.Bool("restart", false, "")
+	if rest, err := parseFlags(flags, args); err != nil || len(rest) > 0 || *athlete == "" {
+		return errUsage
+	}
+
+	conf, err := commandConfig()
+	if err != nil {
+		return err
+	}
+	user, err := commandUser(conf, *athlete)
+	if err != nil {
+		return err
+	}
+	if *restart {
+		if err := db.SaveBackfillCursor(user.ID, 0); err != nil {
+			return fmt.Errorf("Could not reset backfill cursor: %v", err)
+		}
+	}
+
+	complete, err := FetchNewUserActivities(context.Background(), &user)
+	if err != nil {
+		return fmt.Errorf("Backfill of user %v paused, run it again to resume: %v", *athlete, err)
+	}
+	if complete && !user.IsHistoryFetched {
+		if err := db.MarkHistoryFetched(user.ID); err != nil {
+			return fmt.Errorf("Something went wrong updating the user: %v", err)
+		}
+	}
+	fmt.Printf("Backfill of user %v complete\n", *athlete)
+	return nil
+}
+
+// refreshTokenCommand : Refresh the access token of one user
+func refreshTokenCommand(args []string) error {
+	flags := flag.NewFlagSet("refresh-token", flag.ContinueOnError)
+	athlete := flags.String("user", "", "")
+	if rest, err := parseFlags(flags, args); err != nil || len(rest) > 0 || *athlete == "" {
+		return errUsage
+	}
+
+	conf, err := commandConfig()
+	if err != nil {
+		return err
+	}
+	// The rotated tokens could not be saved, the old ones would stop working
+	if conf.DryRun {
+		return fmt.Errorf("Tokens cannot be refreshed during a dry run")
+	}
+	user, err := commandUser(conf, *athlete)
+	if err != nil {
+		return err
+	}
+
+	newUser, err := out.RefreshUserSubscription(context.Background(), &user)
+	if err != nil {
+		return err
+	}
+	if err := db.UpdateUser(&newUser); err != nil {
+		return fmt.Errorf("Could not update user: %v", err)
+	}
+	fmt.Printf("Refreshed the token of user %v, it expires in %v seconds\n", *athlete, newUser.ExpiresIn)
+	return nil
+}
+
+// cacheCommand : Inspect the webhook queue and manage its dead letters
+func cacheCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	all := flags.Bool("all", false, "")
+	names, err := parseFlags(flags, args[1:])
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(conf.CacheDir); err != nil {
+		return fmt.Errorf("Could not open cache directory: %v", err)
+	}
+	// Not opened with queue.Open, which would take back the entries claimed by a running daemon
+	cache := &queue.Queue{Dir: conf.CacheDir}
+
+	switch args[0] {
+	case "ls":
+		if len(names) > 0 || *all {
+			return errUsage
+		}
+		return listCache(cache)
+	case "replay", "purge":
+		if *all == (len(names) > 0) {
+			return errUsage
+		}
+		if *all {
+			if names, err = cache.Dead(); err != nil {
+				return fmt.Errorf("Could not list dead letters: %v", err)
+			}
+		}
+		for _, name := range names {
+			// Paths into the dead letters are accepted as well
+			name = filepath.Base(name)
+			if args[0] == "replay" {
+				if err := cache.Requeue(name); err != nil {
+					return err
+				}
+				fmt.Printf("Requeued %v\n", name)
+			} else {
+				if err := cache.Discard(name); err != nil {
+					return fmt.Errorf("Could not delete dead letter %v: %v", name, err)
+				}
+				fmt.Printf("Deleted %v\n", name)
+			}
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// listCache : Print the number of pending entries and the state of every dead letter
+func listCache(cache *queue.Queue) error {
+	pending, err := cache.Pending()
+	if err != nil {
+		return fmt.Errorf("Could not count pending entries: %v", err)
+	}
+	dead, err := cache.Dead()
+	if err != nil {
+		return fmt.Errorf("Could not list dead letters: %v", err)
+	}
+	fmt.Printf("%v pending entries, %v dead letters\n", pending, len(dead))
+	if len(dead) == 0 {
+		return nil
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tQUEUED AT\tATTEMPTS\tLAST ERROR")
+	for _, name := range dead {
+		entry, err := cache.ReadDead(name)
+		if err != nil {
+			fmt.Fprintf(table, "%v\t\t\t%v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\n", name, entry.QueuedAt.Format("2006-01-02 15:04:05"), entry.Attempts, entry.LastError)
+	}
+	return table.Flush()
+}
+
+// configCommand : Validate the configuration without starting the daemon
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errUsage
+	}
+	conf, err := commandConfig()
+	if err != nil {
+		return err
+	}
+
+	stages := make([]string, 0, len(CleaningStages))
+	for _, stage := range CleaningStages {
+		stages = append(stages, stage.Name())
+	}
+	simplification := "disabled"
+	if Simplification != nil {
+		simplification = fmt.Sprintf("%v (%v m)", conf.SimplifyMethod, conf.SimplifyTolerance)
+	}
+	fmt.Printf("Deployment: %v, storage: %v, dry run: %v, fake Strava: %v\n", conf.DeploymentType, conf.Storage, conf.DryRun, conf.FakeStrava)
+	fmt.Printf("Classification: %v rules, default %v\n", len(ClassificationRules.Rules), ClassificationRules.Default)
+	fmt.Printf("Cleaning: %v, privacy radius: %v m, split pause: %v, simplification: %v\n", strings.Join(stages, ", "), conf.PrivacyRadius, MaxPause, simplification)
+	fmt.Println("Configuration OK")
+	return nil
+}
@@ -11,12 +11,69 @@ type Config struct {
 	PostgresPortEnv    string
 	PostgresDb         string
 	PostgresRequireSSL string `default:"require"`
+	// Storage : Where users and contributions are kept: postgres or memory
+	Storage string `default:"postgres"`
+	// DryRun & DryRunOutput : Write contributions to an NDJSON file (or nowhere) instead of the storage
+	DryRun       bool
+	DryRunOutput string
 
-	StravaClientID      string
-	StravaClientSecret  string
-	CallbackURL         string
-	StravaWebhookURL    string
+	StravaClientID     string
+	StravaClientSecret string
+	CallbackURL        string
+	// StravaVerifyToken : Token Strava sends back when validating the callback URL, generated once and stored when empty
+	StravaVerifyToken string
+	StravaWebhookURL  string
+	StravaAPIURL      string `default:"https://www.strava.com/api/v3"`
+	// StravaTimeout : Timeout of a single Strava request in seconds
+	StravaTimeout       int `default:"30"`
 	StravaMaxActivities int `default:"200"`
+	// StravaBackfillReserve : Fraction of the rate limit budget the history backfill leaves for webhook requests
+	StravaBackfillReserve float64 `default:"0.2"`
+	// FakeStrava : Run against an in-process fake of the Strava API instead of Strava, refused in production
+	FakeStrava bool
+	// FakeStravaFixtures : JSON file with the athletes & activities of the fake Strava API
+	FakeStravaFixtures string
 
-	CacheDir string `default:"cache"`
+	CacheDir     string `default:"cache"`
+	QueueWorkers int    `default:"4"`
+	// QueueMaxAttempts & QueueBackoff : Attempts before an entry is moved to the dead letters, and the first retry delay in seconds (doubled on every attempt)
+	QueueMaxAttempts int `default:"8"`
+	QueueBackoff     int `default:"60"`
+
+	// LogOutput & LogFormat : Where logs are written (stdout, file or both) and how (text or json)
+	LogOutput string `default:"stdout"`
+	LogFormat string `default:"text"`
+	// LogFile, LogMaxSize, LogMaxBackups & LogMaxAge : Log file rotated at the size in MB, rotated files are kept for the number of days
+	LogFile       string `default:"log/go-strava-daemon.log"`
+	LogMaxSize    int    `default:"100"`
+	LogMaxBackups int    `default:"5"`
+	LogMaxAge     int    `default:"28"`
+
+	// SubscriptionCheckInterval : Seconds between checks that the webhook subscription still exists
+	SubscriptionCheckInterval int `default:"600"`
+
+	// ShutdownTimeout : Seconds the shutdown may take after SIGTERM/SIGINT, the work in flight is aborted shortly before
+	ShutdownTimeout int `default:"8"`
+
+	DeauthorizationPolicy string `default:"delete"`
+	// ClassificationRules : JSON file with the rules deciding which activities are kept, built-in rules when empty
+	ClassificationRules string
+	// PrivacyRadius : Radius in meters cut around the start and end of every track, 0 disables it
+	PrivacyRadius float64 `default:"200"`
+
+	// CleanMaxSpeed : Points reached and left faster than this speed in km/h are removed, 0 disables it
+	CleanMaxSpeed float64 `default:"80"`
+	// CleanDuplicates & CleanDuplicateDistance : Remove points closer than this distance in meters to the previous point
+	CleanDuplicates        bool    `default:"true"`
+	CleanDuplicateDistance float64 `default:"1"`
+	// CleanStopRadius & CleanStopDuration : Collapse stops within the radius in meters lasting at least the duration in seconds, 0 disables it
+	CleanStopRadius   float64 `default:"15"`
+	CleanStopDuration int     `default:"60"`
+	// CleanMinLength : Tracks shorter than this length in meters after cleaning and trimming are rejected
+	CleanMinLength float64 `default:"250"`
+	// SplitPause : Activities are split into separate contributions on pauses longer than this duration in seconds, 0 disables it
+	SplitPause int `default:"1800"`
+	// SimplifyMethod & SimplifyTolerance : Optional simplification (douglas-peucker or visvalingam) with a tolerance in meters
+	SimplifyMethod    string
+	SimplifyTolerance float64 `default:"5"`
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/config"
+	"go-strava-daemon/stravafake"
+)
+
+// startFakeStrava : Serve a fake Strava API on a local port and point the configuration to it
+func startFakeStrava(conf *config.Config) stravafake.Fixtures {
+	var fixtures stravafake.Fixtures
+	if conf.FakeStravaFixtures != "" {
+		var err error
+		if fixtures, err = stravafake.LoadFixtures(conf.FakeStravaFixtures); err != nil {
+			log.Fatalf("Could not load fake Strava fixtures: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Could not start fake Strava API: %v", err)
+	}
+	fake := stravafake.New(conf.StravaClientID, conf.StravaClientSecret, fixtures)
+	go func() {
+		if err := http.Serve(listener, fake); err != nil {
+			log.Fatalf("Fake Strava API crashed: %v", err)
+		}
+	}()
+
+	conf.StravaAPIURL = "http://" + listener.Addr().String()
+	conf.StravaWebhookURL = ""
+	if conf.CallbackURL == "" {
+		conf.CallbackURL = "http://localhost:4000/webhook/strava"
+	}
+	log.Infof("Fake Strava API listening on %v with %v athletes", conf.StravaAPIURL, len(fixtures.Athletes))
+	return fixtures
+}
+
+// fakeStravaUsers : Users matching the athletes of the fake Strava API
+func fakeStravaUsers(fixtures stravafake.Fixtures) (users []dbmodel.User) {
+	for _, athlete := range fixtures.Athletes {
+		users = append(users, dbmodel.User{
+			UserIdentifier:    fmt.Sprintf("fake-%v", athlete.ID),
+			Provider:          "web/Strava",
+			ProviderUser:      strconv.Itoa(athlete.ID),
+			AccessToken:       athlete.AccessToken,
+			RefreshToken:      athlete.RefreshToken,
+			TokenCreationDate: time.Now(),
+			ExpiresAt:         int(time.Now().Add(6 * time.Hour).Unix()),
+			ExpiresIn:         int((6 * time.Hour).Seconds()),
+		})
+	}
+	return
+}
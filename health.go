@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout : Time the storage gets to answer a readiness check
+const readinessTimeout = 2 * time.Second
+
+// loopStaleAfter : Missed runs after which an idle background loop is reported as stale
+const loopStaleAfter = 3
+
+// loopState : Last run of a background loop
+type loopState struct {
+	interval time.Duration
+	running  bool
+	started  time.Time
+	finished time.Time
+}
+
+var (
+	loopsMu    sync.Mutex
+	loopStates = map[string]*loopState{}
+)
+
+// loopStarted : Record the start of a run of a background loop
+func loopStarted(name string) {
+	loopsMu.Lock()
+	defer loopsMu.Unlock()
+	state, ok := loopStates[name]
+	if !ok {
+		state = &loopState{}
+		loopStates[name] = state
+	}
+	state.running = true
+	state.started = time.Now()
+}
+
+// loopFinished : Record the end of a run of a background loop, the next run starts after interval
+func loopFinished(name string, interval time.Duration) {
+	loopsMu.Lock()
+	defer loopsMu.Unlock()
+	if state, ok := loopStates[name]; ok {
+		state.running = false
+		state.finished = time.Now()
+		state.interval = interval
+	}
+}
+
+// LoopStatus : Readiness of a background loop, a loop busy with a long run (like a backfill) is not stale
+type LoopStatus struct {
+	LastStarted  time.Time  `json:"last_started"`
+	LastFinished *time.Time `json:"last_finished,omitempty"`
+	Running      bool       `json:"running"`
+	Stale        bool       `json:"stale"`
+}
+
+// CheckStatus : Outcome of a readiness check
+type CheckStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// SubscriptionStatus : State of the Strava webhook subscription
+type SubscriptionStatus struct {
+	Active bool `json:"active"`
+	ID     int  `json:"id,omitempty"`
+}
+
+// Readiness : Body of the readiness endpoint
+type Readiness struct {
+	Ready        bool                  `json:"ready"`
+	Database     CheckStatus           `json:"database"`
+	Subscription SubscriptionStatus    `json:"subscription"`
+	Loops        map[string]LoopStatus `json:"loops"`
+}
+
+// HandleLiveness : Answer as long as the HTTP server is running
+func HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(w, ResponseMessage{
+		Message: "Ok",
+	})
+}
+
+// HandleReadiness : Report the storage, the Strava subscription and the background loops, HTTP 503 when the daemon cannot process events
+func HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{
+		Database: CheckStatus{OK: true},
+		Loops:    map[string]LoopStatus{},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		readiness.Database = CheckStatus{Error: err.Error()}
+	}
+
+	// Reported only: Strava validates a new subscription through this daemon, which must be reachable meanwhile
+	if id := out.SubscriptionID(); id != 0 {
+		readiness.Subscription = SubscriptionStatus{Active: true, ID: id}
+	}
+
+	stale := false
+	now := time.Now()
+	loopsMu.Lock()
+	for name, state := range loopStates {
+		status := LoopStatus{LastStarted: state.started, Running: state.running}
+		if !state.finished.IsZero() {
+			finished := state.finished
+			status.LastFinished = &finished
+			status.Stale = !state.running && now.Sub(finished) > loopStaleAfter*state.interval
+		}
+		stale = stale || status.Stale
+		readiness.Loops[name] = status
+	}
+	loopsMu.Unlock()
+
+	readiness.Ready = readiness.Database.OK && !stale
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	SendJSONResponse(w, readiness)
+}
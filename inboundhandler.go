@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -27,33 +29,57 @@ func SendJSONResponse(w http.ResponseWriter, obj interface{}) {
 
 // HandleStravaWebhook : Handle incoming requests from Strava
 func HandleStravaWebhook(w http.ResponseWriter, r *http.Request) {
+	requestID := webhookRequestID(r)
+	w.Header().Set("X-Request-Id", requestID)
+	logger := log.WithField("request_id", requestID)
+
 	switch r.Method {
 	case "POST":
 		defer r.Body.Close()
 		// Decode the JSON body as struct
 		var msg StravaWebhookMessage
 		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			logger.Warnf("Could not decode webhook message: %v", err)
 			SendJSONResponse(w, ResponseMessage{
 				Message: "Could not decode JSON body",
 			})
+		} else if !knownSubscription(msg.SubscriptionID) {
+			rejectWebhook(w, msg.correlate(requestID), "unknown_subscription", fmt.Sprintf("Rejected webhook message for subscription %v, active subscription is %v", msg.SubscriptionID, out.SubscriptionID()))
 		} else {
-			// Get activity data
-			if err := msg.WriteToDatabase(); err != nil {
-				log.Warnf("Could not get activity data: %v", err)
+			// Persist the message, the queue workers process it asynchronously
+			logger = msg.correlate(requestID)
+			data, err := json.Marshal(&msg)
+			var name string
+			if err == nil {
+				name, err = events.Push(msg.queueKey(data), data, requestID)
+			}
+			if err != nil {
+				logger.Errorf("Could not queue webhook message: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				SendJSONResponse(w, ResponseMessage{
+					Message: "Could not queue message",
+				})
 			} else {
+				webhookEvents.WithLabelValues(knownLabel(msg.ObjectType, "activity", "athlete"), knownLabel(msg.AspectType, "create", "update", "delete")).Inc()
+				logger.WithField("queue_entry", name).Info("Queued webhook message")
+				SendJSONResponse(w, ResponseMessage{
+					Message: "Ok",
+				})
 			}
-			SendJSONResponse(w, ResponseMessage{
-				Message: "Ok",
-			})
 		}
 		break
 	case "GET":
-		// Try to fetch a message from Strava
-		challenge, err := getURLParam("hub.challenge", r)
-		if err != nil {
-			log.Warn("Could not get hub challenge from URL params")
+		// Validate the subscription handshake against our verify token
+		query := r.URL.Query()
+		challenge := query.Get("hub.challenge")
+		if challenge == "" {
+			rejectWebhook(w, logger, "missing_challenge", "Could not get hub challenge from URL params")
+		} else if query.Get("hub.mode") != "subscribe" {
+			rejectWebhook(w, logger, "invalid_mode", fmt.Sprintf("Rejected verification request with hub.mode %q", query.Get("hub.mode")))
+		} else if !knownVerifyToken(query.Get("hub.verify_token")) {
+			rejectWebhook(w, logger, "invalid_verify_token", "Rejected verification request with an invalid verify token")
 		} else {
-			log.Info("Received valid Strava verification request")
+			logger.Info("Received valid Strava verification request")
 			msg := strava.WebhookValidationRequest{
 				HubChallenge: challenge,
 			}
@@ -62,7 +88,7 @@ func HandleStravaWebhook(w http.ResponseWriter, r *http.Request) {
 
 		break
 	default:
-		log.Warnf("Received a HTTP %s request instead of GET or POST on webhook handler", r.Method)
+		logger.Warnf("Received a HTTP %s request instead of GET or POST on webhook handler", r.Method)
 		SendJSONResponse(w, ResponseMessage{
 			Message: fmt.Sprintf("Use HTTP POST or HTTP GET instead of %v", r.Method),
 		})
@@ -70,11 +96,22 @@ func HandleStravaWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// getURLParam : Request a parameter from the URL
-func getURLParam(paramName string, request *http.Request) (result string, err error) {
-	result = request.URL.Query()[paramName][0]
-	if result == "" {
-		err = fmt.Errorf("Param not found in URL")
+// webhookRequestID : ID correlating the logs of a webhook request, taken from the X-Request-Id header when a proxy set it
+func webhookRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		return id
 	}
-	return
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// rejectWebhook : Log, count and refuse a webhook request
+func rejectWebhook(w http.ResponseWriter, logger *log.Entry, reason string, message string) {
+	logger.Warn(message)
+	webhookRejections.WithLabelValues(reason).Inc()
+	w.WriteHeader(http.StatusForbidden)
+	SendJSONResponse(w, ResponseMessage{
+		Message: "Forbidden",
+	})
 }
@@ -3,113 +3,150 @@ package main
 import (
 	// Import the Posgres driver for the database/sql package
 
-	"fmt"
-	"io/ioutil"
+	"context"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/koding/multiconfig"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
-
+	"go-strava-daemon/classify"
 	"go-strava-daemon/config"
 	"go-strava-daemon/outboundhandler"
+	"go-strava-daemon/queue"
+	"go-strava-daemon/ratelimit"
+	"go-strava-daemon/storage"
+	"go-strava-daemon/stravaclient"
+	"go-strava-daemon/track"
 )
 
 // Global variables
 var (
-	db            dbmodel.Database
-	out           outboundhandler.StravaHandler
-	Cachedir      string
-	MaxActivities int
+	db     storage.Store
+	out    outboundhandler.StravaHandler
+	events *queue.Queue
+	// Strava clients sharing one rate limiter, webhook requests get priority over the backfill
+	limiter        *ratelimit.Limiter
+	stravaClient   *stravaclient.Client
+	backfillClient *stravaclient.Client
+	MaxActivities  int
+	// DeauthorizationPolicy : Retention policy for contributions of users who revoke access
+	DeauthorizationPolicy string
+	// ClassificationRules : Rules deciding which activities become contributions
+	ClassificationRules *classify.Rules
+	// PrivacyFilter : Filter applied to every track, the zones of the user are added per activity
+	PrivacyFilter track.Privacy
+	// CleaningStages & MinTrackLength : Stages run before and after the privacy filter
+	CleaningStages []track.Stage
+	MinTrackLength track.MinLength
+	// MaxPause : Activities are split into separate trips on longer pauses, disabled when 0
+	MaxPause time.Duration
+	// Simplification : Optional stage reducing the points of every trip
+	Simplification track.Stage
+	// inFlight : Context of the Strava requests made by the background loops, cancelled when the shutdown timeout passes
+	inFlight = context.Background()
 )
 
-// ReadSecret : Read a file and return it's content as string - used for Docker secrets
-func ReadSecret(file string) string {
-	data, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.Fatalf("Could not fetch secret: %v", err)
-	}
-	return string(data)
-}
-
 func main() {
-	// Set logging to file
-	logfile, err := os.OpenFile(fmt.Sprintf("log/%v.log", time.Now().Unix()), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("Could not create logfile: %v", err)
+	// Run an operator command instead of the daemon when one is given
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
 	}
-	log.SetOutput(logfile)
 
 	// Load configuration values
 	conf := &config.Config{}
 	multiconfig.MustLoad(&conf)
-	Cachedir = conf.CacheDir
-	MaxActivities = conf.StravaMaxActivities
-
-	// Check configuration type
-	if conf.DeploymentType == "production" {
-		port, _ := strconv.ParseInt(ReadSecret(conf.PostgresPortEnv), 10, 64)
-
-		conf.PostgresHost = ReadSecret(conf.PostgresHost)
-		conf.PostgresUser = ReadSecret(conf.PostgresUser)
-		conf.PostgresPassword = ReadSecret(conf.PostgresPassword)
-		conf.PostgresPort = port
-		conf.PostgresDb = ReadSecret(conf.PostgresDb)
-		conf.StravaClientID = ReadSecret(conf.StravaClientID)
-		conf.StravaClientSecret = ReadSecret(conf.StravaClientSecret)
-	} else {
-		if conf.CallbackURL == "" || conf.PostgresDb == "" || conf.PostgresHost == "" || conf.PostgresPassword == "" || conf.PostgresPort == 0 || conf.PostgresRequireSSL == "" || conf.PostgresUser == "" || conf.StravaClientID == "" || conf.StravaClientSecret == "" || conf.StravaWebhookURL == "" {
-			log.Fatal("Configuration not complete")
-		}
+	if err := configureLogging(conf); err != nil {
+		log.Fatal(err)
 	}
-
-	// Subscribe to Strava
-	out = outboundhandler.StravaHandler{
-		ClientID:     conf.StravaClientID,
-		ClientSecret: conf.StravaClientSecret,
-		CallbackURL:  conf.CallbackURL,
-		// Generate a new token on restarting
-		VerifyToken: strconv.FormatInt(time.Now().Unix(), 10),
-		EndPoint:    conf.StravaWebhookURL,
+	if err := configure(conf); err != nil {
+		log.Fatal(err)
 	}
 
-	db = dbmodel.Database{
-		PostgresHost:       conf.PostgresHost,
-		PostgresUser:       conf.PostgresUser,
-		PostgresPassword:   conf.PostgresPassword,
-		PostgresPort:       conf.PostgresPort,
-		PostgresDb:         conf.PostgresDb,
-		PostgresRequireSSL: conf.PostgresRequireSSL,
+	// Prepare the Strava clients & storage
+	fixtures := connectStrava(conf)
+	stravaClient.Observe = observeStravaRequest
+	backfillClient.Observe = observeStravaRequest
+	if err := openStorage(conf, fixtures); err != nil {
+		log.Fatal(err)
+	}
+	if err := restoreSubscription(conf); err != nil {
+		log.Fatal(err)
 	}
-	db.VerifyConnection()
-
-	// Unsubscribe from previous connections
-	out.UnsubscribeFromStrava()
 
-	// Subscribe in a thread so that the API can go online
-	go out.SubscribeToStrava()
+	// Open the queue of stravawebhookrequests
+	var err error
+	if events, err = queue.Open(conf.CacheDir); err != nil {
+		log.Fatalf("Could not open queue: %v", err)
+	}
+	events.MaxAttempts = conf.QueueMaxAttempts
+	events.Backoff = time.Duration(conf.QueueBackoff) * time.Second
+	if dead, err := events.Dead(); err != nil {
+		log.Warnf("Could not list dead letters: %v", err)
+	} else if len(dead) > 0 {
+		log.Warnf("%v queue entries in the dead letters of %v", len(dead), conf.CacheDir)
+	}
+	registerStateMetrics()
+
+	// Background loops run until stop is called, abort cancels their requests in flight
+	ctx, stop := context.WithCancel(context.Background())
+	var abort context.CancelFunc
+	inFlight, abort = context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	run := func(loop func(ctx context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			loop(ctx)
+		}()
+	}
 
-	// Handle expiring users from Strava
-	go HandleExpiringUsers()
+	// Handle expiring users from Strava, a dry run must not rotate the tokens of the source store
+	if !conf.DryRun {
+		run(HandleExpiringUsers)
+	}
 
 	// Handle fetching data from new Strava users
-	go HandleNewUsers()
+	run(HandleNewUsers)
 
-	// Handle cached stravawebhookrequests
-	go HandleCache()
+	// Handle queued stravawebhookrequests
+	run(func(ctx context.Context) {
+		HandleQueue(ctx, conf.QueueWorkers)
+	})
 
 	// Launch the API
 	log.Info("Launching HTTP API")
 	// Handle endpoints - add below if required
 	http.HandleFunc("/webhook/strava", HandleStravaWebhook)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", HandleLiveness)
+	http.HandleFunc("/readyz", HandleReadiness)
 
-	// Run the server untill a Fatal error occurs
-	if err := http.ListenAndServe(":4000", nil); err != nil {
-		log.Fatalf("Webserver crashed: %v", err)
+	// Listen before subscribing, Strava validates a new subscription by calling the daemon
+	listener, err := net.Listen("tcp", ":4000")
+	if err != nil {
+		log.Fatalf("Could not listen on port 4000: %v", err)
 	}
+
+	// Run the server untill a Fatal error occurs or the daemon is stopped
+	server := &http.Server{}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Fatalf("Webserver crashed: %v", err)
+		}
+	}()
+
+	// Keep the Strava subscription, it is only recreated when it changed or disappeared
+	run(func(ctx context.Context) {
+		HandleSubscription(ctx, time.Duration(conf.SubscriptionCheckInterval)*time.Second)
+	})
+
+	log.Infof("Received %v, shutting down", waitForSignal())
+	shutdown(server, stop, abort, &loops, time.Duration(conf.ShutdownTimeout)*time.Second)
 }
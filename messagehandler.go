@@ -1,19 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha1"
+	"database/sql"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
 	geo "github.com/paulmach/go.geo"
 	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/stravaclient"
+	"go-strava-daemon/track"
 )
 
 // StravaWebhookMessage : Body of incoming webhook messages
@@ -25,32 +25,138 @@ type StravaWebhookMessage struct {
 	SubscriptionID int         `json:"subscription_id"`
 	EventTime      int         `json:"event_time"`
 	Updates        interface{} `json:"updates"`
+
+	// logEntry : Logger with the correlation fields of the message
+	logEntry *log.Entry
+}
+
+// correlate : Log the message with its correlation fields and the ID of the webhook request that delivered it
+func (msg *StravaWebhookMessage) correlate(requestID string) *log.Entry {
+	fields := log.Fields{
+		"subscription_id": msg.SubscriptionID,
+		"owner_id":        msg.OwnerID,
+		"object_id":       msg.ObjectID,
+		"object_type":     msg.ObjectType,
+		"aspect_type":     msg.AspectType,
+	}
+	if requestID != "" {
+		fields["request_id"] = requestID
+	}
+	msg.logEntry = log.WithFields(fields)
+	return msg.logEntry
+}
+
+// logger : Logger of the message, with the correlation fields
+func (msg *StravaWebhookMessage) logger() *log.Entry {
+	if msg.logEntry == nil {
+		return msg.correlate("")
+	}
+	return msg.logEntry
 }
 
-// StravaActivity : Struct representing an activity from Strava
+// queueKey : Key of the message in the queue, a redelivered event gets the same key
+func (msg *StravaWebhookMessage) queueKey(data []byte) string {
+	// Distinct updates of an object within the same second differ in their content
+	sum := sha1.Sum(data)
+	return fmt.Sprintf("%v-%v-%v-%v-%v-%v-%x", msg.SubscriptionID, msg.OwnerID, msg.ObjectType, msg.ObjectID, msg.AspectType, msg.EventTime, sum[:4])
+}
+
+// Timestamp sources used when converting an activity into a contribution
+const (
+	TimeSourceStreams      = "streams"
+	TimeSourceInterpolated = "interpolated"
+)
+
+// Conversion : Steps turning the track of an activity into contributions
+type Conversion struct {
+	// Cleaning : Stages applied to the whole track
+	Cleaning track.Pipeline
+	// MaxPause : The cleaned track is split where no point was recorded for longer, disabled when 0
+	MaxPause time.Duration
+	// Privacy : Filter applied to every part of the split track, splitting it again at the zones
+	Privacy track.Privacy
+	// Trip : Stages applied to every trip left after the privacy filter
+	Trip track.Pipeline
+}
+
+// StravaActivity : Struct representing an activity from Strava together with the derived track
 type StravaActivity struct {
-	Distance           float32   `json:"distance"`
-	MovingTime         int       `json:"moving_time"`
-	ElapsedTime        int       `json:"elapsed_time"`
-	TotalElevationGain float64   `json:"total_elevation_gain"`
-	Type               string    `json:"type"`
-	WorkoutType        int       `json:"workout_type"`
-	StartDateLocal     time.Time `json:"start_date_local"`
-	EndDateLocal       time.Time
-	PointsTime         []time.Time
-	StartLatlng        []float64         `json:"start_latlng"`
-	EndLatlng          []float64         `json:"end_latlng"`
-	Map                StravaActivityMap `json:"map"`
-	Commute            bool              `json:"commute"`
-	LineString         *geo.Path
-}
-
-// StravaActivityMap : Struct representing the Map field in an activity message
-type StravaActivityMap struct {
-	ID              string `json:"id"`
-	Polyline        string `json:"polyline"`
-	ResourceState   int    `json:"resource_state"`
-	SummaryPolyline string `json:"summary_polyline"`
+	stravaclient.Activity
+	EndDateLocal time.Time
+	PointsTime   []time.Time
+	LineString   *geo.Path
+	Streams      *stravaclient.StreamSet
+	TimeSource   string
+
+	// logEntry : Logger with the correlation fields of the message or backfill the activity came from
+	logEntry *log.Entry
+}
+
+// logger : Logger of the activity, with the correlation fields
+func (activity *StravaActivity) logger() *log.Entry {
+	if activity.logEntry == nil {
+		activity.logEntry = log.WithField("object_id", activity.ID)
+	}
+	return activity.logEntry
+}
+
+// fetchStreams : Fetch the latlng/time/distance/altitude streams of the activity
+func (activity *StravaActivity) fetchStreams(ctx context.Context, client *stravaclient.Client, accessToken string) error {
+	streams, err := client.GetActivityStreams(ctx, accessToken, activity.ID, "latlng", "time", "distance", "altitude")
+	if err != nil {
+		return err
+	}
+	activity.Streams = &streams
+	return nil
+}
+
+// loadStreams : Fetch the streams, the polyline is only used as fallback when the activity has no streams
+// Other errors are returned so the activity is retried instead of being stored from the polyline
+func (activity *StravaActivity) loadStreams(ctx context.Context, client *stravaclient.Client, accessToken string) error {
+	err := activity.fetchStreams(ctx, client, accessToken)
+	switch {
+	case err == nil:
+		return nil
+	case stravaclient.IsNotFound(err):
+		activity.logger().Infof("Activity %v has no streams, falling back to polyline", activity.ID)
+		return nil
+	case stravaclient.IsRateLimited(err):
+		return fmt.Errorf("Strava responded with HTTP 429: Too many requests when retrieving streams of activity %v", activity.ID)
+	case ctx.Err() != nil:
+		return fmt.Errorf("Could not fetch streams of activity %v: %v", activity.ID, ctx.Err())
+	}
+	return fmt.Errorf("Could not fetch streams of activity %v: %w", activity.ID, err)
+}
+
+// applyStreams : Build the geometry and per-point timestamps from the activity streams
+func (activity *StravaActivity) applyStreams() error {
+	if activity.Streams == nil {
+		return fmt.Errorf("No streams available")
+	}
+	latlng := activity.Streams.LatLng.Data
+	offsets := activity.Streams.Time.Data
+	if len(latlng) == 0 {
+		return fmt.Errorf("The latlng stream is empty")
+	}
+	if len(latlng) != len(offsets) {
+		return fmt.Errorf("The latlng stream (%v points) and time stream (%v points) differ in length", len(latlng), len(offsets))
+	}
+
+	path := geo.NewPath()
+	timeStamps := make([]time.Time, 0, len(latlng))
+	for i, point := range latlng {
+		if len(point) != 2 {
+			return fmt.Errorf("Invalid latlng point at index %v", i)
+		}
+		// geo.Point is stored as [lng, lat]
+		path.Push(geo.NewPoint(point[1], point[0]))
+		timeStamps = append(timeStamps, activity.StartDateLocal.Add(time.Duration(offsets[i])*time.Second))
+	}
+
+	activity.LineString = path
+	activity.PointsTime = timeStamps
+	activity.EndDateLocal = timeStamps[len(timeStamps)-1]
+	return nil
 }
 
 // decodePolyline : Convert an encoded polyline into a decoded geo.Path object
@@ -66,7 +172,7 @@ func (activity *StravaActivity) decodePolyline() {
 // createTimeStampArray : Function to create a TimestampArray from the StartDateLocal and ElapsedTime
 func (activity *StravaActivity) createTimeStampArray() error {
 	start := activity.StartDateLocal
-	activity.EndDateLocal = start.Add(time.Duration(activity.ElapsedTime))
+	activity.EndDateLocal = start.Add(time.Duration(activity.ElapsedTime) * time.Second)
 	nbOfIntervals := activity.LineString.PointSet.Length()
 	if nbOfIntervals == 0 {
 		return fmt.Errorf("There were 0 location points, could not create timestamp array")
@@ -80,143 +186,279 @@ func (activity *StravaActivity) createTimeStampArray() error {
 	return nil
 }
 
-// ConvertToContribution : Convert a Strava activity to a database contribution
-func (activity *StravaActivity) ConvertToContribution() (contribution dbmodel.Contribution, err error) {
-	// Convert polyline to useable format
-	activity.decodePolyline()
-	// Generate timestamp per coordinate
-	activity.createTimeStampArray()
-	contribution = dbmodel.Contribution{
-		UserAgent:      "app/Strava",
-		Distance:       int(activity.Distance),
-		TimeStampStart: activity.StartDateLocal,
-		TimeStampStop:  activity.EndDateLocal,
-		Duration:       activity.ElapsedTime,
-		PointsGeom:     activity.LineString,
-		PointsTime:     activity.PointsTime,
+// ConvertToContributions : Convert a Strava activity to database contributions, one per trip between long pauses
+func (activity *StravaActivity) ConvertToContributions(conversion Conversion) (contributions []dbmodel.Contribution, err error) {
+	// Prefer the recorded streams, fall back to interpolating over the polyline
+	if err := activity.applyStreams(); err == nil {
+		activity.TimeSource = TimeSourceStreams
+	} else {
+		if activity.Streams != nil {
+			activity.logger().Warnf("Could not use streams of activity %v, interpolating timestamps instead: %v", activity.ID, err)
+		}
+		// Convert polyline to useable format
+		activity.decodePolyline()
+		// Generate timestamp per coordinate
+		if err := activity.createTimeStampArray(); err != nil {
+			return nil, err
+		}
+		activity.TimeSource = TimeSourceInterpolated
 	}
-	return
-}
+	activity.logger().Infof("Converted activity %v using %v timestamps", activity.ID, activity.TimeSource)
 
-// writeToCache : Write a StravaWebhookMessage to cache & fetch it later
-func (msg *StravaWebhookMessage) writeToCache() error {
-	// Marshall message to bytes
-	data, err := json.Marshal(&msg)
+	full, err := track.New(activity.LineString, activity.PointsTime)
 	if err != nil {
-		return err
+		return
 	}
-	// Write to file
-	err = ioutil.WriteFile(fmt.Sprintf("%v/%v.tmp", Cachedir, time.Now().Unix()), data, 0644)
-	return err
-}
 
-// WriteToDatabase : Write activity message to database
-func (msg *StravaWebhookMessage) WriteToDatabase() error {
-	if msg.ObjectType == "activity" {
-		var activity StravaActivity
-
-		// Get owner information from database
-		user, err := db.GetUserData(strconv.Itoa(msg.OwnerID))
-		if err != nil {
-			return fmt.Errorf("Could not get user information: %v", err)
+	// Clean the track, split it on long pauses and hide the start, end and privacy zones of every part
+	cleaned, results := conversion.Cleaning.Apply(full)
+	maxPause := conversion.MaxPause
+	if activity.TimeSource != TimeSourceStreams {
+		// Interpolated timestamps are evenly spread, a gap between them is no pause
+		maxPause = 0
+	}
+	var trips []track.Track
+	for _, part := range cleaned.Split(maxPause) {
+		hidden := conversion.Privacy.Split(part)
+		removed := part.Len()
+		for _, trip := range hidden {
+			removed -= trip.Len()
 		}
+		results = results.Add(track.Results{{Stage: conversion.Privacy.Name(), Removed: removed}})
+		trips = append(trips, hidden...)
+	}
 
-		// Fetch activity
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities/%v", msg.ObjectID), nil)
-		if err != nil {
-			return fmt.Errorf("Could not create request: %v", err)
+	kept := 0
+	for _, part := range trips {
+		trip, tripResults := conversion.Trip.Apply(part)
+		results = results.Add(tripResults)
+		if trip.Len() < 2 {
+			continue
 		}
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", user.AccessToken))
+		kept += trip.Len()
 
-		response, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("Could not make request: %v", err)
-		}
-		defer response.Body.Close()
-
-		// Except strava request limit exceeded: write message to cache
-		if response.StatusCode == 429 {
-			if err := msg.writeToCache(); err != nil {
-				return fmt.Errorf("Strava responded with HTTP 429 and could not write message to cache: %v", err)
-			}
-			return fmt.Errorf("Strava responded with HTTP 429: Too many requests when retrieving activity data (activity %v for user %v)", msg.ObjectID, msg.OwnerID)
+		// Distance and duration follow the resulting trip
+		contributions = append(contributions, dbmodel.Contribution{
+			UserAgent:      "app/Strava",
+			Distance:       int(trip.Distance()),
+			TimeStampStart: trip.Start(),
+			TimeStampStop:  trip.Stop(),
+			Duration:       int(trip.Duration().Seconds()),
+			PointsGeom:     trip.Path,
+			PointsTime:     trip.Times,
+		})
+	}
+	for _, result := range results {
+		trackPointsRemoved.WithLabelValues(result.Stage).Add(float64(result.Removed))
+	}
+	activity.logger().Infof("Kept %v of %v points of activity %v in %v of %v trips (removed %v)", kept, full.Len(), activity.ID, len(contributions), len(trips), results)
+	for _, result := range results {
+		if result.Stage == "simplify" && kept > 0 {
+			activity.logger().Infof("Simplification of activity %v kept %v of %v points (ratio %.2f)", activity.ID, kept, kept+result.Removed, float64(kept+result.Removed)/float64(kept))
 		}
+	}
 
-		if err := json.NewDecoder(response.Body).Decode(&activity); err != nil {
-			return fmt.Errorf("Could not decode response body: %v", err)
-		}
+	if len(contributions) == 0 {
+		err = track.ErrTooShort
+	}
+	return
+}
+
+// classify : Apply the classification rules, rejected activities are recorded with the reason they were dropped
+func (activity *StravaActivity) classify(user *dbmodel.User) (accepted bool, err error) {
+	decision := ClassificationRules.Classify(&activity.Activity)
+	if decision.Accepted {
+		return true, nil
+	}
 
-		// Check activity type: cycling
-		if activity.Type == "Ride" && activity.WorkoutType == 10 {
-			// Convert activity to contribution
-			contrib, err := activity.ConvertToContribution()
-			if err != nil {
-				return fmt.Errorf("Could not convert activity to contribution: %v", err)
-			}
-
-			// Store in database
-			if err = db.AddContribution(&contrib, &user); err != nil {
-				err = fmt.Errorf("Could not save contribution: %v", err)
-			} else {
-				log.Info("Contribution written to database")
-			}
+	reason := fmt.Sprintf("%v (type %v, workout type %v)", decision.Reason(), activity.Type, activity.WorkoutType)
+	return false, rejectActivity(activity, user, decision.Rule, reason)
+}
+
+// rejectActivity : Count and record a rejected activity, contributions stored from an earlier version are removed
+func rejectActivity(activity *StravaActivity, user *dbmodel.User, rule string, reason string) error {
+	activityRejections.WithLabelValues(rule).Inc()
+	deleted, err := db.RejectActivity(user, activity.ID, reason)
+	if err != nil {
+		return fmt.Errorf("Could not record rejection of activity %v: %v", activity.ID, err)
+	}
+	activity.logger().Infof("Rejected activity %v: %v (removed %v stored contributions)", activity.ID, reason, deleted)
+	return nil
+}
+
+// fetchActivity : Fetch the activity of the message
+func (msg *StravaWebhookMessage) fetchActivity(ctx context.Context, user *dbmodel.User) (activity StravaActivity, err error) {
+	activity.logEntry = msg.logger().WithField("user_id", user.ID)
+	activity.Activity, err = stravaClient.GetActivity(ctx, user.AccessToken, int64(msg.ObjectID))
+	if err != nil {
+		// Except strava request limit exceeded: the queue retries the message later
+		if stravaclient.IsRateLimited(err) {
+			err = fmt.Errorf("Strava responded with HTTP 429: Too many requests when retrieving activity data (activity %v for user %v)", msg.ObjectID, msg.OwnerID)
+		} else if stravaclient.IsNotFound(err) {
+			err = permanent(fmt.Errorf("Activity %v does not exist anymore: %v", msg.ObjectID, err))
 		} else {
-			return fmt.Errorf("The activity is not a cycling trip %s", "")
+			err = fmt.Errorf("Could not fetch activity %v: %v", msg.ObjectID, err)
 		}
 	}
+	return
+}
+
+// conversionFor : Cleaning stages, then the privacy filter with the zones of the user, the minimum length check and the optional simplification per trip
+func conversionFor(zones []track.Zone) Conversion {
+	trip := []track.Stage{MinTrackLength}
+	if Simplification != nil {
+		trip = append(trip, Simplification)
+	}
+	return Conversion{
+		Cleaning: track.Pipeline{Stages: CleaningStages},
+		MaxPause: MaxPause,
+		Privacy:  PrivacyFilter.WithZones(zones),
+		Trip:     track.Pipeline{Stages: trip},
+	}
+}
+
+// storeActivity : Convert a cycling activity to contributions and store them, activities that cannot be converted are rejected
+func storeActivity(activity *StravaActivity, user *dbmodel.User) error {
+	zones, err := db.GetPrivacyZones(user.ID)
+	if err != nil {
+		return fmt.Errorf("Could not get privacy zones of user %v: %v", user.ID, err)
+	}
+
+	// Convert activity to contributions, retrying would give the same result
+	contributions, err := activity.ConvertToContributions(conversionFor(zones))
+	if err != nil {
+		activity.logger().Warnf("Could not convert activity %v to contribution: %v", activity.ID, err)
+		return rejectActivity(activity, user, "conversion", fmt.Sprintf("conversion failed: %v", err))
+	}
+
+	// Store in database, replacing the contributions of an earlier delivery of the same activity
+	replaced, err := db.SaveActivityContributions(contributions, user, activity.ID, activity.TimeSource)
+	if err != nil {
+		return fmt.Errorf("Could not save contributions: %v", err)
+	}
+	activitiesAccepted.Inc()
+	contributionsStored.Add(float64(len(contributions)))
+	activity.logger().Infof("%v contributions of activity %v written to database (replaced %v)", len(contributions), activity.ID, replaced)
 	return nil
 }
 
-// GetFiles : Fetch files in a certain directory
-func GetFiles(dir string, filetype string) (files []string, err error) {
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && strings.Contains(path, filetype) {
-			files = append(files, path)
-		}
-		return nil
-	})
+// owner : Get the user owning the object of the message, unknown users are a permanent error
+func (msg *StravaWebhookMessage) owner() (user dbmodel.User, err error) {
+	user, err = db.GetUserData(strconv.Itoa(msg.OwnerID))
+	if err == sql.ErrNoRows {
+		err = permanent(fmt.Errorf("Unknown user %v", msg.OwnerID))
+	} else if err != nil {
+		err = fmt.Errorf("Could not get user information: %v", err)
+	}
 	return
 }
 
-// HandleCache : Check if any files are in cache and fetch their data
-func HandleCache() {
-	for {
-		// Check if there are any cache files
-		if files, err := GetFiles(Cachedir, "tmp"); err != nil {
-			log.Errorf("Could not fetch cache files: %v", err)
-		} else {
-			if len(files) < 1 {
-				log.Info("No new cache files found")
-			} else {
-				// Loop over files
-				for _, file := range files {
-					// Attempt to read cachefile
-					if data, err := ioutil.ReadFile(file); err != nil {
-						log.Errorf("Could not read cachefile: %v", err)
-					} else {
-						// Decode into stravawebhookmessage
-						var msg *StravaWebhookMessage
-						if err := json.Unmarshal(data, &msg); err != nil {
-							log.Errorf("Could not decode cachefile into stravawebhookmessage: %v", err)
-						} else {
-							// Attempt deleting file
-							if err := msg.WriteToDatabase(); err != nil {
-								log.Errorf("Could not write cachefile content to database: %v", err)
-							} else {
-								log.Infof("Wrote cachefile (%v) data to database", file)
-								// Delete file
-								if err := os.Remove(file); err != nil {
-									log.Errorf("Could not delete cachefile: %v", err)
-								}
-							}
-						}
-					}
-				}
-			}
+// WriteToDatabase : Apply an activity message to the database
+func (msg *StravaWebhookMessage) WriteToDatabase(ctx context.Context) error {
+	switch msg.ObjectType {
+	case "activity":
+		switch msg.AspectType {
+		case "create":
+			return msg.createActivity(ctx)
+		case "update":
+			return msg.updateActivity(ctx)
+		case "delete":
+			return msg.deleteActivity()
+		default:
+			return permanent(fmt.Errorf("Unknown aspect type %v for activity %v", msg.AspectType, msg.ObjectID))
 		}
+	case "athlete":
+		return msg.updateAthlete()
+	default:
+		return nil
+	}
+}
 
-		// Sleep for an hour
-		time.Sleep(1 * time.Hour)
+// updateAthlete : Purge the data of an athlete who revoked access to our application
+func (msg *StravaWebhookMessage) updateAthlete() error {
+	updates, _ := msg.Updates.(map[string]interface{})
+	if authorized, ok := updates["authorized"]; !ok || fmt.Sprint(authorized) != "false" {
+		return nil
+	}
+
+	user, err := msg.owner()
+	if err != nil {
+		return err
 	}
+
+	affected, err := db.PurgeUser(&user, DeauthorizationPolicy, "strava deauthorization")
+	if err != nil {
+		return fmt.Errorf("Could not purge deauthorized user %v: %v", msg.OwnerID, err)
+	}
+	msg.logger().WithField("user_id", user.ID).Infof("Purged data of deauthorized user %v (policy %v, %v contributions)", user.ID, DeauthorizationPolicy, affected)
+	return nil
+}
+
+// createActivity : Fetch a new activity and store it when it is a cycling trip
+func (msg *StravaWebhookMessage) createActivity(ctx context.Context) error {
+	// Get owner information from database
+	user, err := msg.owner()
+	if err != nil {
+		return err
+	}
+
+	activity, err := msg.fetchActivity(ctx, &user)
+	if err != nil {
+		return err
+	}
+
+	// Check activity type: cycling
+	if accepted, err := activity.classify(&user); err != nil || !accepted {
+		return err
+	}
+	if err := activity.loadStreams(ctx, stravaClient, user.AccessToken); err != nil {
+		return err
+	}
+	return storeActivity(&activity, &user)
+}
+
+// updateActivity : Re-evaluate an activity after the owner changed its type or visibility
+func (msg *StravaWebhookMessage) updateActivity(ctx context.Context) error {
+	updates, _ := msg.Updates.(map[string]interface{})
+
+	// Private activities are removed, only type and visibility changes require a re-fetch
+	if private, ok := updates["private"]; ok && fmt.Sprint(private) == "true" {
+		return msg.deleteActivity()
+	}
+	_, typeChanged := updates["type"]
+	_, privacyChanged := updates["private"]
+	if !typeChanged && !privacyChanged {
+		msg.logger().Infof("Ignoring update of activity %v: no relevant fields changed", msg.ObjectID)
+		return nil
+	}
+
+	// Get owner information from database
+	user, err := msg.owner()
+	if err != nil {
+		return err
+	}
+
+	activity, err := msg.fetchActivity(ctx, &user)
+	if err != nil {
+		return err
+	}
+
+	// Rejecting or storing the activity replaces the stored version
+	if accepted, err := activity.classify(&user); err != nil || !accepted {
+		return err
+	}
+	if err := activity.loadStreams(ctx, stravaClient, user.AccessToken); err != nil {
+		return err
+	}
+	return storeActivity(&activity, &user)
+}
+
+// deleteActivity : Remove the contributions of an activity
+func (msg *StravaWebhookMessage) deleteActivity() error {
+	deleted, err := db.DeleteActivity(int64(msg.ObjectID))
+	if err != nil {
+		return fmt.Errorf("Could not delete activity %v: %v", msg.ObjectID, err)
+	}
+	msg.logger().Infof("Removed %v contributions of activity %v", deleted, msg.ObjectID)
+	return nil
 }
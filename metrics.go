@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/ratelimit"
+)
+
+// metricsNamespace : Prefix of all metrics exposed on /metrics
+const metricsNamespace = "strava_daemon"
+
+var (
+	// webhookEvents : Webhook events queued per object and aspect type
+	webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_events_total",
+		Help:      "Webhook events queued, by object and aspect type.",
+	}, []string{"object_type", "aspect_type"})
+	// webhookRejections : Number of refused webhook requests per reason
+	webhookRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_rejections_total",
+		Help:      "Webhook requests refused, by reason.",
+	}, []string{"reason"})
+
+	// activitiesAccepted & contributionsStored : Activities stored and the contributions (one per trip) created from them
+	activitiesAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "activities_accepted_total",
+		Help:      "Activities stored as contributions.",
+	})
+	contributionsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "contributions_stored_total",
+		Help:      "Contributions stored, one per trip of an accepted activity.",
+	})
+	// activityRejections : Number of activities dropped per classification rule, conversion failures use the rule "conversion"
+	activityRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "activities_rejected_total",
+		Help:      "Activities not stored, by the classification rule that rejected them.",
+	}, []string{"reason"})
+	// trackPointsRemoved : Number of points removed per conversion pipeline stage
+	trackPointsRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "track_points_removed_total",
+		Help:      "Track points removed, by conversion stage.",
+	}, []string{"stage"})
+
+	// stravaRequests, stravaRequestDuration & stravaRateLimited : Requests to the Strava API per operation
+	stravaRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "strava_requests_total",
+		Help:      "Requests to the Strava API, by operation and HTTP status (0 when no response was received).",
+	}, []string{"operation", "status"})
+	stravaRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "strava_request_duration_seconds",
+		Help:      "Latency of the requests to the Strava API, by operation.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation"})
+	stravaRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "strava_rate_limited_total",
+		Help:      "Requests to the Strava API answered with HTTP 429, by operation.",
+	}, []string{"operation"})
+
+	// tokenRefreshes : Access token refreshes per result
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token refreshes, by result (success or failure).",
+	}, []string{"result"})
+
+	// backfillUsers, backfillUsersCompleted & backfillActivities : Progress of the history backfill
+	backfillUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backfill_users",
+		Help:      "Users whose history is being fetched, by stage (waiting or running).",
+	}, []string{"stage"})
+	backfillUsersCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backfill_users_completed_total",
+		Help:      "Users whose history was fetched completely.",
+	})
+	backfillActivities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backfill_activities_total",
+		Help:      "Activities of the history backfill, by stage (listed or handled).",
+	}, []string{"stage"})
+)
+
+// observeStravaRequest : Record a request to the Strava API, used as stravaclient.Client.Observe
+func observeStravaRequest(operation string, status int, duration time.Duration) {
+	stravaRequests.WithLabelValues(operation, strconv.Itoa(status)).Inc()
+	stravaRequestDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if status == 429 {
+		stravaRateLimited.WithLabelValues(operation).Inc()
+	}
+}
+
+// knownLabel : Label value for a value sent by a client, unexpected values are grouped as "other" to bound the number of series
+func knownLabel(value string, known ...string) string {
+	for _, k := range known {
+		if value == k {
+			return value
+		}
+	}
+	return "other"
+}
+
+// registerStateMetrics : Expose the rate limit budget and the queue depth, read when the metrics are scraped
+func registerStateMetrics() {
+	remaining := map[string]func(b ratelimit.Budget) int{
+		"short": func(b ratelimit.Budget) int { return b.ShortLimit - b.ShortUsage },
+		"daily": func(b ratelimit.Budget) int { return b.DailyLimit - b.DailyUsage },
+	}
+	for window, left := range remaining {
+		left := left
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "strava_ratelimit_remaining",
+			Help:        "Requests left in the Strava rate limit, by window (short is 15 minutes).",
+			ConstLabels: prometheus.Labels{"window": window},
+		}, func() float64 {
+			return float64(left(limiter.Budget()))
+		})
+	}
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_pending",
+		Help:      "Webhook events waiting in the queue.",
+	}, func() float64 {
+		pending, err := events.Pending()
+		if err != nil {
+			log.Warnf("Could not count pending queue entries: %v", err)
+		}
+		return float64(pending)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_dead",
+		Help:      "Webhook events in the dead letters of the queue.",
+	}, func() float64 {
+		dead, err := events.Dead()
+		if err != nil {
+			log.Warnf("Could not list dead letters: %v", err)
+		}
+		return float64(len(dead))
+	})
+}
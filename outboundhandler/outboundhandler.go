@@ -1,152 +1,134 @@
 package outboundhandler
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
-	"strings"
-	"time"
+	"sync/atomic"
 
 	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
-	"github.com/bikedataproject/go-bike-data-lib/strava"
 	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/stravaclient"
 )
 
 // StravaHandler : Object to handle outgoing Strava requests
 type StravaHandler struct {
-	ClientID     string
-	ClientSecret string
-	CallbackURL  string
-	VerifyToken  string
-	EndPoint     string
+	CallbackURL string
+	VerifyToken string
+	// Client : Strava API client, shares the rate limiter with the other Strava requests
+	Client *stravaclient.Client
+	// ReadOnly : Only use a matching subscription, subscriptions are never created or deleted (dry runs)
+	ReadOnly bool
+
+	subscriptionID int64
+}
+
+// errReadOnly : Returned when changing the subscriptions of a read-only handler
+var errReadOnly = fmt.Errorf("Strava subscriptions cannot be changed during a dry run")
+
+// SubscriptionID : ID of the active subscription, 0 while there is none
+func (conf *StravaHandler) SubscriptionID() int {
+	return int(atomic.LoadInt64(&conf.subscriptionID))
+}
+
+// SetSubscriptionID : Use a subscription known from elsewhere, like the storage shared with other instances, until the next reconciliation
+func (conf *StravaHandler) SetSubscriptionID(id int) {
+	atomic.StoreInt64(&conf.subscriptionID, int64(id))
 }
 
-// makeRequest : Perform a HTTP request
-func (conf StravaHandler) makeRequest(endpoint string, httpverb string, payload *bytes.Buffer) (response *http.Response, err error) {
-	client := &http.Client{}
-	request, err := http.NewRequest(httpverb, endpoint, payload)
+// Reconcile : Make sure Strava has a subscription for CallbackURL, a matching subscription is kept and any other one is replaced
+func (conf *StravaHandler) Reconcile(ctx context.Context) error {
+	subscriptions, err := conf.Client.ListSubscriptions(ctx)
 	if err != nil {
-		return
+		return fmt.Errorf("Could not get active subscriptions: %v", err)
 	}
 
-	response, err = client.Do(request)
-	if err != nil {
-		return
+	for _, subscription := range subscriptions {
+		if subscription.CallbackURL == conf.CallbackURL {
+			if previous := atomic.SwapInt64(&conf.subscriptionID, int64(subscription.ID)); previous != int64(subscription.ID) {
+				log.Infof("Using existing Strava subscription (ID = %v)", subscription.ID)
+			}
+			return nil
+		}
 	}
 
-	if response.StatusCode == 429 {
-		err = fmt.Errorf("Got HTTP 429 as response: too many requests")
+	// Strava allows a single subscription per application, remove the one pointing elsewhere
+	if previous := atomic.SwapInt64(&conf.subscriptionID, 0); previous != 0 {
+		log.Warnf("Strava subscription %v is gone", previous)
 	}
-	return
+	if conf.ReadOnly {
+		log.Warnf("Dry run: not subscribing %v to Strava, %v other subscriptions are left in place", conf.CallbackURL, len(subscriptions))
+		return nil
+	}
+	for _, subscription := range subscriptions {
+		if err := conf.Client.DeleteSubscription(ctx, subscription.ID); err != nil {
+			return fmt.Errorf("Could not unsubscribe from ID %v: %v", subscription.ID, err)
+		}
+		log.Infof("Unsubscribed from %v (ID = %v)", subscription.CallbackURL, subscription.ID)
+	}
+	_, err = conf.CreateSubscription(ctx)
+	return err
 }
 
-// SubscribeToStrava : Subscribe to the strava webhooks service
-func (conf *StravaHandler) SubscribeToStrava() (err error) {
-	log.Info("10 seconds idle before subscription request")
-	time.Sleep(10 * time.Second)
-	log.Info("Subscribing to Strava")
-	response, err := conf.makeRequest(fmt.Sprintf("%s?client_id=%s&client_secret=%s&callback_url=%s&verify_token=%s", conf.EndPoint, conf.ClientID, conf.ClientSecret, conf.CallbackURL, conf.VerifyToken), "POST", &bytes.Buffer{})
-	if err != nil {
-		return err
+// CreateSubscription : Create a subscription right away, the callback URL must answer the validation request with the verify token
+func (conf *StravaHandler) CreateSubscription(ctx context.Context) (subscription stravaclient.Subscription, err error) {
+	if conf.ReadOnly {
+		err = errReadOnly
+		return
 	}
-	body, err := ioutil.ReadAll(response.Body)
+	log.Info("Subscribing to Strava")
+	subscription, err = conf.Client.CreateSubscription(ctx, conf.CallbackURL, conf.VerifyToken)
 	if err != nil {
-		return err
+		err = fmt.Errorf("Could not subscribe to Strava: %v", err)
+		return
 	}
-	log.Infof("Strava subscription responded with: %v", string(body))
+	atomic.StoreInt64(&conf.subscriptionID, int64(subscription.ID))
+	log.Infof("Strava subscription created (ID = %v)", subscription.ID)
 	return
 }
 
-// UnsubscribeFromStrava : Delete the current subscription from Strava
-func (conf *StravaHandler) UnsubscribeFromStrava() {
+// UnsubscribeFromStrava : Delete all subscriptions of the application from Strava
+func (conf *StravaHandler) UnsubscribeFromStrava(ctx context.Context) error {
+	if conf.ReadOnly {
+		return errReadOnly
+	}
 	// Get current subscriptions
-	response, err := conf.makeRequest(fmt.Sprintf("%v?client_id=%v&client_secret=%v", conf.EndPoint, conf.ClientID, conf.ClientSecret), "GET", &bytes.Buffer{})
+	subscriptions, err := conf.Client.ListSubscriptions(ctx)
 	if err != nil {
-		log.Fatalf("Could not get active subscriptions: %v", err)
-	}
-	defer response.Body.Close()
-
-	decoder := json.NewDecoder(response.Body)
-	var msg []strava.SubscriptionMessage
-	if err := decoder.Decode(&msg); err != nil {
-		log.Fatalf("Could not decode subscription message: %v", err)
+		return fmt.Errorf("Could not get active subscriptions: %v", err)
 	}
 
-	for _, m := range msg {
+	for _, m := range subscriptions {
 		// Unsubscribe
-		client := &http.Client{}
-		payload := &bytes.Buffer{}
-		writer := multipart.NewWriter(payload)
-		_ = writer.WriteField("client_id", conf.ClientID)
-		_ = writer.WriteField("client_secret", conf.ClientSecret)
-		err := writer.Close()
-		if err != nil {
-			log.Fatalf("Could not close payload: %v", err)
-		}
-
-		request, err := http.NewRequest("DELETE", fmt.Sprintf("%v/%v", conf.EndPoint, m.ID), payload)
-		if err != nil {
-			log.Fatalf("Could not create HTTP request: %v", err)
-		}
-
-		request.Header.Set("Content-Type", writer.FormDataContentType())
-		response, err = client.Do(request)
-		if err != nil {
-			log.Fatalf("Could not make unsubscribe request: %v", err)
-		}
-
-		// Handle responsecodes
-		switch response.StatusCode {
-		case 204:
-			log.Infof("Unsubscribed successfully! (ID = %v)", m.ID)
-			break
-		case 429:
-			log.Warnf("Received HTTP 429 when trying to unsubscribe from ID %v", m.ID)
-			break
-		default:
-			break
+		if err := conf.Client.DeleteSubscription(ctx, m.ID); err != nil {
+			if stravaclient.IsRateLimited(err) {
+				log.Warnf("Received HTTP 429 when trying to unsubscribe from ID %v", m.ID)
+			} else {
+				log.Warnf("Could not unsubscribe from ID %v: %v", m.ID, err)
+			}
+			continue
 		}
+		atomic.CompareAndSwapInt64(&conf.subscriptionID, int64(m.ID), 0)
+		log.Infof("Unsubscribed successfully! (ID = %v)", m.ID)
 	}
+	return nil
 }
 
-// RefreshUserSubscription : Refresh the subscription from a user
-func (conf StravaHandler) RefreshUserSubscription(user *dbmodel.User) (newUser dbmodel.User, err error) {
-	// Create HTTPClient
-	client := &http.Client{}
-	// Initialise data
-	payload := strings.NewReader(fmt.Sprintf("client_id=%s&client_secret=%s&grant_type=refresh_token&refresh_token=%s", conf.ClientID, conf.ClientSecret, user.RefreshToken))
-	// Prepare request
-	req, err := http.NewRequest("POST", "https://www.strava.com/api/v3/oauth/token", payload)
+// RefreshUserSubscription : Refresh the subscription from a user, cancelling ctx aborts the request and the wait for the rate limit
+func (conf *StravaHandler) RefreshUserSubscription(ctx context.Context, user *dbmodel.User) (newUser dbmodel.User, err error) {
+	msg, err := conf.Client.RefreshToken(ctx, user.RefreshToken)
 	if err != nil {
+		// Handle HTTP 429: Too many requests
+		if stravaclient.IsRateLimited(err) {
+			err = fmt.Errorf("Strava responded with HTTP 429 (too many requests) trying to refresh user %v's access token", user.ID)
+		} else {
+			err = fmt.Errorf("Could not refresh subscription of user %v: %v", user.ID, err)
+		}
 		return
 	}
-	// Set content-type
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	// Make request
-	response, err := client.Do(req)
-	if err != nil {
-		return
-	}
-	defer response.Body.Close()
-
-	// Handle HTTP 429: Too many requests
-	if response.StatusCode == 429 {
-		err = fmt.Errorf("Strava responded with HTTP 429 (too many requests) trying to refresh user %v's access token", user.ID)
-		return
-	}
-
-	// Decode body into RefreshMessage
-	decoder := json.NewDecoder(response.Body)
-	var msg strava.RefreshMessage
-	if err := decoder.Decode(&msg); err != nil {
-		err = fmt.Errorf("Could not decode subscription refresh message: %v", err)
-	}
 
 	if msg.AccessToken == "" && msg.RefreshToken == "" {
-		err = fmt.Errorf("Failed to continue subscription refreshing due to HTTP response: %v", response)
+		err = fmt.Errorf("Failed to continue subscription refreshing: Strava returned no tokens for user %v", user.ID)
 		return
 	}
 
@@ -157,8 +139,8 @@ func (conf StravaHandler) RefreshUserSubscription(user *dbmodel.User) (newUser d
 		RefreshToken:   msg.RefreshToken,
 		ExpiresAt:      msg.ExpiresAt,
 		ExpiresIn:      msg.ExpiresIn,
-		// User does not expire before 5 hours in the database, data is fetched within 10seconds
-		IsHistoryFetched: true,
+		// Only the tokens change, a paused history backfill resumes on the next run
+		IsHistoryFetched: user.IsHistoryFetched,
 	}
 
 	return
@@ -0,0 +1,353 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Extension : File extension of queue entries
+const Extension = ".tmp"
+
+// partialExtension : File extension of entries that are still being written
+const partialExtension = ".partial"
+
+// processingDir : Subdirectory holding the entries that are claimed by a worker
+const processingDir = "processing"
+
+// deadDir : Subdirectory holding the entries that will not be retried anymore
+const deadDir = "dead"
+
+// ErrClaimed : Returned when an entry was already claimed by another worker
+var ErrClaimed = errors.New("Queue entry is already claimed")
+
+// Entry : Queued message together with its delivery state
+type Entry struct {
+	Message   json.RawMessage `json:"message"`
+	QueuedAt  time.Time       `json:"queued_at"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	NextRetry time.Time       `json:"next_retry"`
+	// RequestID : ID of the request that queued the message, used to correlate the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Queue : Durable queue storing every entry as a file in a directory
+type Queue struct {
+	Dir string
+	// MaxAttempts : Number of failed attempts after which an entry is moved to the dead letters
+	MaxAttempts int
+	// Backoff & MaxBackoff : Delay before the first retry, doubled after every failed attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	ready chan string
+}
+
+// Open : Open the queue in a directory, entries left in processing by a previous run are put back
+func Open(dir string) (*Queue, error) {
+	q := &Queue{
+		Dir:         dir,
+		MaxAttempts: 8,
+		Backoff:     time.Minute,
+		MaxBackoff:  24 * time.Hour,
+		ready:       make(chan string, 1024),
+	}
+	for _, sub := range []string{processingDir, deadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("Could not create queue directory: %v", err)
+		}
+	}
+
+	// Remove entries that were being written when the previous run stopped
+	for _, sub := range []string{"", processingDir, deadDir} {
+		partial, err := GetFiles(filepath.Join(dir, sub), partialExtension)
+		if err != nil {
+			return nil, fmt.Errorf("Could not list partial entries: %v", err)
+		}
+		for _, file := range partial {
+			os.Remove(file)
+		}
+	}
+
+	// Recover entries of workers that were interrupted
+	if _, err := q.ReleaseClaimed(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// decode : Decode a stored entry, files written before entries had a delivery state only hold the message
+func decode(data []byte) (entry Entry, err error) {
+	if err = json.Unmarshal(data, &entry); err != nil || entry.Message == nil {
+		entry = Entry{Message: json.RawMessage(data)}
+		if !json.Valid(data) {
+			err = fmt.Errorf("Queue entry is not valid JSON")
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// writePartial : Write an entry to a partial file next to path, GetFiles does not pick it up
+// Every call gets its own partial file, so concurrent writes of the same entry do not mix
+func writePartial(path string, entry Entry) (partial string, err error) {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"+partialExtension)
+	if err != nil {
+		return
+	}
+	partial = file.Name()
+	if err = file.Chmod(0644); err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return
+}
+
+// write : Store an entry in a file, replacing it at once so that readers never see a half-written entry
+func write(path string, entry Entry) error {
+	partial, err := writePartial(path, entry)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
+
+// entryName : File name of the entry for a key, characters other than letters, digits, - and _ are replaced
+func entryName(key string) string {
+	name := []rune(key)
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			name[i] = '_'
+		}
+	}
+	return string(name) + Extension
+}
+
+// Push : Persist a message under a key and signal it to the workers, a message with a key that is already pending is not stored twice
+func (q *Queue) Push(key string, data []byte, requestID string) (name string, err error) {
+	name = entryName(key)
+	path := filepath.Join(q.Dir, name)
+	partial, err := writePartial(path, Entry{Message: data, QueuedAt: time.Now().UTC(), RequestID: requestID})
+	if err != nil {
+		return
+	}
+
+	// Linking fails when the entry exists, unlike renaming which would reset its delivery state
+	err = os.Link(partial, path)
+	os.Remove(partial)
+	if os.IsExist(err) {
+		return name, nil
+	} else if err != nil {
+		return
+	}
+
+	// The sweep picks the entry up when the workers are too busy
+	select {
+	case q.ready <- name:
+	default:
+	}
+	return
+}
+
+// Ready : Channel of entries that are ready to be processed
+func (q *Queue) Ready() <-chan string {
+	return q.ready
+}
+
+// Sweep : Signal every pending entry that is due for a retry to the workers, stops when ctx is cancelled
+func (q *Queue) Sweep(ctx context.Context) error {
+	files, err := GetFiles(q.Dir, Extension)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, file := range files {
+		// Unreadable entries are signalled so that the worker moves them to the dead letters
+		if data, err := ioutil.ReadFile(file); err == nil {
+			if entry, err := decode(data); err == nil && entry.NextRetry.After(now) {
+				continue
+			}
+		}
+		select {
+		case q.ready <- filepath.Base(file):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Pending : Number of entries waiting to be processed
+func (q *Queue) Pending() (int, error) {
+	files, err := GetFiles(q.Dir, Extension)
+	return len(files), err
+}
+
+// Claim : Take an entry out of the pending entries, the entry is returned even when it cannot be decoded
+func (q *Queue) Claim(name string) (entry Entry, err error) {
+	claimed := filepath.Join(q.Dir, processingDir, name)
+	if err = os.Rename(filepath.Join(q.Dir, name), claimed); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrClaimed
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(claimed)
+	if err != nil {
+		return
+	}
+	return decode(data)
+}
+
+// Ack : Remove a processed entry
+func (q *Queue) Ack(name string) error {
+	return os.Remove(filepath.Join(q.Dir, processingDir, name))
+}
+
+// Release : Put a claimed entry back so that it is retried on the next sweep
+func (q *Queue) Release(name string) error {
+	if err := os.Rename(filepath.Join(q.Dir, processingDir, name), filepath.Join(q.Dir, name)); err != nil {
+		return fmt.Errorf("Could not release queue entry %v: %v", name, err)
+	}
+	return nil
+}
+
+// ReleaseClaimed : Put back every claimed entry, used when no worker is running anymore
+func (q *Queue) ReleaseClaimed() (released int, err error) {
+	claimed, err := GetFiles(filepath.Join(q.Dir, processingDir), Extension)
+	if err != nil {
+		return 0, fmt.Errorf("Could not list claimed entries: %v", err)
+	}
+	for _, file := range claimed {
+		if err := q.Release(filepath.Base(file)); err != nil {
+			return released, err
+		}
+		released++
+	}
+	return
+}
+
+// Fail : Record a failed attempt of a claimed entry, it is retried after a backoff or moved to the dead letters after MaxAttempts
+func (q *Queue) Fail(name string, entry Entry, cause error) (dead bool, err error) {
+	entry.Attempts++
+	entry.LastError = cause.Error()
+	if entry.Attempts >= q.MaxAttempts {
+		return true, q.Bury(name, entry, cause)
+	}
+
+	backoff := q.Backoff
+	for i := 1; i < entry.Attempts && backoff < q.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.MaxBackoff {
+		backoff = q.MaxBackoff
+	}
+	entry.NextRetry = time.Now().Add(backoff).UTC()
+
+	claimed := filepath.Join(q.Dir, processingDir, name)
+	if err = write(claimed, entry); err != nil {
+		return false, fmt.Errorf("Could not update queue entry %v: %v", name, err)
+	}
+	return false, q.Release(name)
+}
+
+// Bury : Move a claimed entry to the dead letters, it is not retried anymore
+func (q *Queue) Bury(name string, entry Entry, cause error) error {
+	entry.LastError = cause.Error()
+	entry.NextRetry = time.Time{}
+	claimed := filepath.Join(q.Dir, processingDir, name)
+	// Corrupt entries are kept as they are
+	if json.Valid(entry.Message) {
+		if err := write(claimed, entry); err != nil {
+			return fmt.Errorf("Could not update queue entry %v: %v", name, err)
+		}
+	}
+	if err := os.Rename(claimed, filepath.Join(q.Dir, deadDir, name)); err != nil {
+		return fmt.Errorf("Could not move queue entry %v to the dead letters: %v", name, err)
+	}
+	return nil
+}
+
+// Dead : Names of the entries in the dead letters
+func (q *Queue) Dead() (names []string, err error) {
+	files, err := GetFiles(filepath.Join(q.Dir, deadDir), Extension)
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	return
+}
+
+// ReadDead : Read an entry of the dead letters
+func (q *Queue) ReadDead(name string) (Entry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.Dir, deadDir, name))
+	if err != nil {
+		return Entry{}, err
+	}
+	return decode(data)
+}
+
+// Requeue : Move an entry of the dead letters back to the pending entries with a fresh attempt count
+func (q *Queue) Requeue(name string) error {
+	dead := filepath.Join(q.Dir, deadDir, name)
+	entry, err := q.ReadDead(name)
+	if err != nil {
+		return fmt.Errorf("Could not read dead letter %v: %v", name, err)
+	}
+	entry.Attempts = 0
+	entry.NextRetry = time.Time{}
+	if err := write(dead, entry); err != nil {
+		return fmt.Errorf("Could not update dead letter %v: %v", name, err)
+	}
+	if err := os.Rename(dead, filepath.Join(q.Dir, name)); err != nil {
+		return fmt.Errorf("Could not requeue dead letter %v: %v", name, err)
+	}
+	return nil
+}
+
+// Discard : Delete an entry of the dead letters
+func (q *Queue) Discard(name string) error {
+	return os.Remove(filepath.Join(q.Dir, deadDir, name))
+}
+
+// GetFiles : Fetch files with a certain extension in a directory, subdirectories are skipped
+func GetFiles(dir string, filetype string) (files []string, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == filetype {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return
+}
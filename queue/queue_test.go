@@ -0,0 +1,407 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestQueue : Open a queue in a temporary directory, remove removes the directory
+func openTestQueue(t *testing.T) (q *Queue, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, err = Open(dir); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return q, func() { os.RemoveAll(dir) }
+}
+
+// pending : Count the pending entries
+func pending(t *testing.T, q *Queue) int {
+	t.Helper()
+	n, err := q.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestEntryName(t *testing.T) {
+	tests := map[string]string{
+		"1-12345-activity-1001-create": "1-12345-activity-1001-create.tmp",
+		"a/b\\c.d":                     "a_b_c_d.tmp",
+		"../escape":                    "___escape.tmp",
+		"with space_ok":                "with_space_ok.tmp",
+	}
+	for key, want := range tests {
+		if got := entryName(key); got != want {
+			t.Errorf("entryName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		message string
+		valid   bool
+	}{
+		{"entry", `{"message":{"object_id":1},"attempts":2}`, `{"object_id":1}`, true},
+		// Files of earlier versions only hold the message
+		{"bare message", `{"object_id":1}`, `{"object_id":1}`, true},
+		{"corrupt", `{"object_id":`, `{"object_id":`, false},
+	}
+	for _, test := range tests {
+		entry, err := decode([]byte(test.data))
+		if (err == nil) != test.valid {
+			t.Errorf("%v: error %v, want valid=%v", test.name, err, test.valid)
+		}
+		if string(entry.Message) != test.message {
+			t.Errorf("%v: message %s, want %s", test.name, entry.Message, test.message)
+		}
+	}
+}
+
+func TestPushDeduplicates(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name, err := q.Push("event", []byte(`{"object_id":1}`), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Push("event", []byte(`{"object_id":1}`), "second"); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, q); n != 1 {
+		t.Fatalf("%v pending entries, want 1", n)
+	}
+	if signalled := <-q.Ready(); signalled != name {
+		t.Errorf("signalled %v, want %v", signalled, name)
+	}
+
+	// The first delivery is kept with its request ID
+	entry, err := q.Claim(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.RequestID != "first" || entry.Attempts != 0 {
+		t.Errorf("claimed %+v, want the first delivery", entry)
+	}
+	if _, err := q.Claim(name); err != ErrClaimed {
+		t.Errorf("second claim returned %v, want %v", err, ErrClaimed)
+	}
+	if err := q.Ack(name); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, q); n != 0 {
+		t.Errorf("%v pending entries after the ack, want 0", n)
+	}
+}
+
+func TestConcurrentPushes(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+
+	// Webhook deliveries of the same event racing each other
+	errs := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			_, err := q.Push("event", []byte(fmt.Sprintf(`{"object_id":1,"delivery":%v}`, i)), "")
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := pending(t, q); n != 1 {
+		t.Errorf("%v pending entries, want 1", n)
+	}
+	if entry, err := q.Claim(entryName("event")); err != nil || !json.Valid(entry.Message) {
+		t.Errorf("claimed %+v (%v)", entry, err)
+	}
+	if partial, err := GetFiles(q.Dir, partialExtension); err != nil || len(partial) != 0 {
+		t.Errorf("partial files %v (%v) left", partial, err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name, err := q.Push("event", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(name); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, q); n != 0 {
+		t.Fatalf("%v pending entries while claimed, want 0", n)
+	}
+	if err := q.Release(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(name); err != nil {
+		t.Errorf("released entry cannot be claimed: %v", err)
+	}
+	if err := q.Release("missing" + Extension); err == nil {
+		t.Error("released an entry that was not claimed")
+	}
+}
+
+func TestFailBacksOffAndBuries(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	q.MaxAttempts = 3
+	q.Backoff = time.Minute
+	name, err := q.Push("event", []byte(`{"object_id":1}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		entry, err := q.Claim(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := time.Now()
+		dead, err := q.Fail(name, entry, errors.New("failed"))
+		if err != nil || dead {
+			t.Fatalf("attempt %v: dead=%v err=%v", attempt+1, dead, err)
+		}
+
+		// The entry is pending again, but not due before the backoff
+		entry, err = q.Claim(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Attempts != attempt+1 || entry.LastError != "failed" {
+			t.Errorf("attempt %v: entry %+v", attempt+1, entry)
+		}
+		if wait := entry.NextRetry.Sub(before); wait < backoff || wait > backoff+time.Second {
+			t.Errorf("attempt %v: retry after %v, want %v", attempt+1, wait, backoff)
+		}
+		if err := q.Release(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry, err := q.Claim(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead, err := q.Fail(name, entry, errors.New("failed again")); err != nil || !dead {
+		t.Fatalf("last attempt: dead=%v err=%v", dead, err)
+	}
+	dead, err := q.Dead()
+	if err != nil || len(dead) != 1 || dead[0] != name {
+		t.Fatalf("dead letters %v (%v), want %v", dead, err, name)
+	}
+	if n := pending(t, q); n != 0 {
+		t.Errorf("%v pending entries, want 0", n)
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	q.MaxAttempts = 100
+	q.Backoff = time.Hour
+	q.MaxBackoff = 3 * time.Hour
+	name, err := q.Push("event", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.Claim(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Attempts = 10
+	if _, err := q.Fail(name, entry, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err = q.Claim(name); err != nil {
+		t.Fatal(err)
+	}
+	if wait := time.Until(entry.NextRetry); wait > q.MaxBackoff {
+		t.Errorf("retry after %v, want at most %v", wait, q.MaxBackoff)
+	}
+}
+
+func TestRequeueResetsAttempts(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name, err := q.Push("event", []byte(`{"object_id":1}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.Claim(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Attempts = 5
+	if err := q.Bury(name, entry, errors.New("unknown user")); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err = q.ReadDead(name); err != nil || entry.LastError != "unknown user" {
+		t.Fatalf("dead letter %+v (%v)", entry, err)
+	}
+
+	if err := q.Requeue(name); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err = q.Claim(name); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Attempts != 0 || !entry.NextRetry.IsZero() || string(entry.Message) != `{"object_id":1}` {
+		t.Errorf("requeued entry %+v, want a fresh attempt of the same message", entry)
+	}
+}
+
+func TestBuryKeepsCorruptEntries(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name := "corrupt" + Extension
+	if err := ioutil.WriteFile(filepath.Join(q.Dir, name), []byte(`{"object_id":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.Claim(name)
+	if err == nil {
+		t.Fatal("claimed a corrupt entry without error")
+	}
+	if err := q.Bury(name, entry, err); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(q.Dir, deadDir, name))
+	if err != nil || string(data) != `{"object_id":` {
+		t.Errorf("dead letter %s (%v), want the corrupt content", data, err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name, err := q.Push("event", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.Claim(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Bury(name, entry, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Discard(name); err != nil {
+		t.Fatal(err)
+	}
+	if dead, err := q.Dead(); err != nil || len(dead) != 0 {
+		t.Errorf("dead letters %v (%v) after discarding, want none", dead, err)
+	}
+}
+
+func TestOpenRecovers(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	name, err := q.Push("event", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(name); err != nil {
+		t.Fatal(err)
+	}
+	// Left over by an interrupted write
+	partial := filepath.Join(q.Dir, "other"+Extension+partialExtension)
+	if err := ioutil.WriteFile(partial, []byte(`{`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(q.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, reopened); n != 1 {
+		t.Errorf("%v pending entries after reopening, want the claimed entry back", n)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial entry was not removed: %v", err)
+	}
+}
+
+func TestReleaseClaimed(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	for _, key := range []string{"a", "b"} {
+		name, err := q.Push(key, []byte(`{}`), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Claim(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released, err := q.ReleaseClaimed()
+	if err != nil || released != 2 {
+		t.Fatalf("released %v (%v), want 2", released, err)
+	}
+	if n := pending(t, q); n != 2 {
+		t.Errorf("%v pending entries, want 2", n)
+	}
+}
+
+func TestSweepSkipsEntriesNotDue(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	due, err := q.Push("due", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := q.Push("later", []byte(`{}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := q.Claim(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Fail(later, entry, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	// Drain the signals of Push
+	for len(q.ready) > 0 {
+		<-q.ready
+	}
+
+	if err := q.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.ready) != 1 || <-q.ready != due {
+		t.Errorf("sweep signalled the wrong entries, want only %v", due)
+	}
+}
+
+func TestSweepStopsWhenCancelled(t *testing.T) {
+	q, remove := openTestQueue(t)
+	defer remove()
+	q.ready = make(chan string)
+	if _, err := q.Push("event", []byte(`{}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Sweep(ctx); err != context.Canceled {
+		t.Errorf("sweep returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/queue"
+)
+
+// permanentError : Error that retrying the message cannot resolve
+type permanentError struct {
+	err error
+}
+
+// Error : Describe the error
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent : Mark an error as permanent, the queue entry is moved to the dead letters without further retries
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// HandleQueue : Drain the webhook queue with a pool of workers until ctx is cancelled, returns once the workers finished their entries
+func HandleQueue(ctx context.Context, workers int) {
+	var running sync.WaitGroup
+	defer running.Wait()
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			queueWorker(ctx)
+		}()
+	}
+
+	for {
+		// Pick up entries that are due for a retry or left over from a previous run
+		loopStarted("queue")
+		if err := events.Sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Could not sweep queue: %v", err)
+		}
+		loopFinished("queue", time.Minute)
+
+		// Sweep every minute
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Minute):
+		}
+	}
+}
+
+// queueWorker : Process entries as they become ready, signalled entries stay in the queue when ctx is cancelled
+func queueWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-events.Ready():
+			if ctx.Err() != nil {
+				return
+			}
+			processQueueEntry(name)
+		}
+	}
+}
+
+// processQueueEntry : Write a queued webhook message to the database, failed entries are retried with a backoff
+func processQueueEntry(name string) {
+	logger := log.WithField("queue_entry", name)
+	entry, err := events.Claim(name)
+	if err == queue.ErrClaimed {
+		return
+	} else if err != nil {
+		logger.Errorf("Could not read queue entry %v: %v", name, err)
+		if err := events.Bury(name, entry, err); err != nil {
+			logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	if entry.RequestID != "" {
+		logger = logger.WithField("request_id", entry.RequestID)
+	}
+	var msg StravaWebhookMessage
+	if err := json.Unmarshal(entry.Message, &msg); err != nil {
+		logger.Errorf("Could not decode queue entry %v into stravawebhookmessage: %v", name, err)
+		if err := events.Bury(name, entry, err); err != nil {
+			logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	logger = msg.correlate(entry.RequestID).WithField("queue_entry", name)
+	msg.logEntry = logger
+	err = msg.WriteToDatabase(inFlight)
+	if err == nil {
+		if err := events.Ack(name); err != nil {
+			logger.Errorf("Could not delete queue entry %v: %v", name, err)
+		}
+		return
+	}
+
+	// Aborted by the shutdown, the attempt does not count
+	if inFlight.Err() != nil {
+		logger.Warnf("Processing of queue entry %v was aborted by the shutdown, it is retried on the next start: %v", name, err)
+		if err := events.Release(name); err != nil {
+			logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	// Permanent failures are not retried
+	if _, ok := err.(permanentError); ok {
+		logger.Errorf("Could not write queue entry %v to database, moving it to the dead letters: %v", name, err)
+		if err := events.Bury(name, entry, err); err != nil {
+			logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	dead, failErr := events.Fail(name, entry, err)
+	if failErr != nil {
+		logger.Errorf("%v", failErr)
+	}
+	if dead {
+		logger.Errorf("Could not write queue entry %v to database after %v attempts, moved it to the dead letters: %v", name, entry.Attempts+1, err)
+	} else {
+		logger.Warnf("Could not write queue entry %v to database (attempt %v/%v): %v", name, entry.Attempts+1, events.MaxAttempts, err)
+	}
+}
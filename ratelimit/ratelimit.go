@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Priority : Priority of an outgoing request, realtime requests may use the budget reserved for them
+type Priority int
+
+// Request priorities
+const (
+	Realtime Priority = iota
+	Backfill
+)
+
+// String : Name of the priority
+func (p Priority) String() string {
+	if p == Backfill {
+		return "backfill"
+	}
+	return "realtime"
+}
+
+// Default limits used until Strava reported the real ones
+const (
+	DefaultShortLimit = 100
+	DefaultDailyLimit = 1000
+)
+
+// window : Usage within one of the Strava rate limit windows
+type window struct {
+	limit int
+	usage int
+	reset time.Time
+	next  func(time.Time) time.Time
+}
+
+// roll : Reset the usage when the window has passed
+func (w *window) roll(now time.Time) bool {
+	if now.Before(w.reset) {
+		return false
+	}
+	w.usage = 0
+	w.reset = w.next(now)
+	return true
+}
+
+// available : Number of requests that can still be made within the window
+func (w *window) available(reserve float64) int {
+	return w.limit - w.usage - int(math.Ceil(float64(w.limit)*reserve))
+}
+
+// nextQuarter : Strava resets the short window every quarter of an hour
+func nextQuarter(now time.Time) time.Time {
+	return now.UTC().Truncate(15 * time.Minute).Add(15 * time.Minute)
+}
+
+// nextMidnight : Strava resets the daily window at midnight UTC
+func nextMidnight(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// Budget : Snapshot of the rate limit budget
+type Budget struct {
+	ShortLimit int       `json:"short_limit"`
+	ShortUsage int       `json:"short_usage"`
+	ShortReset time.Time `json:"short_reset"`
+	DailyLimit int       `json:"daily_limit"`
+	DailyUsage int       `json:"daily_usage"`
+	DailyReset time.Time `json:"daily_reset"`
+}
+
+// Limiter : Paces all outgoing Strava requests based on the X-RateLimit headers
+type Limiter struct {
+	// BackfillReserve : Fraction of every window that backfill requests leave for realtime requests
+	BackfillReserve float64
+
+	mu           sync.Mutex
+	initialized  bool
+	short        window
+	daily        window
+	lastBackfill time.Time
+}
+
+// init : Set the default windows, must be called with the lock held
+func (l *Limiter) init(now time.Time) {
+	if l.initialized {
+		return
+	}
+	l.short = window{limit: DefaultShortLimit, reset: nextQuarter(now), next: nextQuarter}
+	l.daily = window{limit: DefaultDailyLimit, reset: nextMidnight(now), next: nextMidnight}
+	l.initialized = true
+}
+
+// reserve : Reserve a request or return how long to wait before trying again
+func (l *Limiter) reserve(now time.Time, priority Priority) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init(now)
+	if l.short.roll(now) {
+		log.Infof("Strava rate limit budget: %v/%v (15 minutes), %v/%v (daily)", l.short.usage, l.short.limit, l.daily.usage, l.daily.limit)
+	}
+	l.daily.roll(now)
+
+	reserve := 0.0
+	if priority == Backfill {
+		reserve = l.BackfillReserve
+	}
+
+	// Wait for the window that is exhausted
+	for _, w := range []*window{&l.daily, &l.short} {
+		if w.available(reserve) <= 0 {
+			return w.reset.Sub(now)
+		}
+	}
+
+	// Spread backfill requests over the remainder of the short window
+	if priority == Backfill {
+		interval := l.short.reset.Sub(now) / time.Duration(l.short.available(reserve))
+		if next := l.lastBackfill.Add(interval); now.Before(next) {
+			return next.Sub(now)
+		}
+		l.lastBackfill = now
+	}
+
+	l.short.usage++
+	l.daily.usage++
+	return 0
+}
+
+// Wait : Block until a request of the given priority fits in the budget
+func (l *Limiter) Wait(ctx context.Context, priority Priority) error {
+	for {
+		delay := l.reserve(time.Now(), priority)
+		if delay <= 0 {
+			return nil
+		}
+		if delay > time.Minute {
+			log.Warnf("Strava rate limit budget exhausted for %v requests, waiting %v", priority, delay.Round(time.Second))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Update : Take over the limits and usage reported by Strava
+func (l *Limiter) Update(response *http.Response) {
+	limits := parsePair(response.Header.Get("X-RateLimit-Limit"))
+	usage := parsePair(response.Header.Get("X-RateLimit-Usage"))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init(time.Now())
+
+	if limits != nil {
+		l.short.limit, l.daily.limit = limits[0], limits[1]
+	}
+	if usage != nil {
+		l.short.usage, l.daily.usage = usage[0], usage[1]
+	}
+
+	// Usage headers may lag behind, a 429 means the short window is spent
+	if response.StatusCode == http.StatusTooManyRequests && l.short.usage < l.short.limit {
+		l.short.usage = l.short.limit
+	}
+}
+
+// Budget : Current rate limit budget
+func (l *Limiter) Budget() Budget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init(time.Now())
+	return Budget{
+		ShortLimit: l.short.limit,
+		ShortUsage: l.short.usage,
+		ShortReset: l.short.reset,
+		DailyLimit: l.daily.limit,
+		DailyUsage: l.daily.usage,
+		DailyReset: l.daily.reset,
+	}
+}
+
+// parsePair : Parse a "15 minute,daily" header value
+func parsePair(value string) []int {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return nil
+	}
+	pair := make([]int, 2)
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil
+		}
+		pair[i] = n
+	}
+	return pair
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testNow : Start of a short window
+var testNow = time.Date(2020, 7, 27, 16, 0, 0, 0, time.UTC)
+
+func TestParsePair(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{"600,30000", []int{600, 30000}},
+		{" 12 , 345 ", []int{12, 345}},
+		{"", nil},
+		{"600", nil},
+		{"600,30000,1", nil},
+		{"600,many", nil},
+	}
+	for _, test := range tests {
+		got := parsePair(test.value)
+		if len(got) != len(test.want) || (got != nil && (got[0] != test.want[0] || got[1] != test.want[1])) {
+			t.Errorf("parsePair(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestWindowResets(t *testing.T) {
+	tests := []struct {
+		next func(time.Time) time.Time
+		now  time.Time
+		want time.Time
+	}{
+		{nextQuarter, time.Date(2020, 7, 27, 16, 7, 30, 0, time.UTC), time.Date(2020, 7, 27, 16, 15, 0, 0, time.UTC)},
+		{nextQuarter, time.Date(2020, 7, 27, 16, 15, 0, 0, time.UTC), time.Date(2020, 7, 27, 16, 30, 0, 0, time.UTC)},
+		{nextQuarter, time.Date(2020, 7, 27, 23, 59, 0, 0, time.UTC), time.Date(2020, 7, 28, 0, 0, 0, 0, time.UTC)},
+		{nextMidnight, time.Date(2020, 7, 27, 16, 7, 30, 0, time.UTC), time.Date(2020, 7, 28, 0, 0, 0, 0, time.UTC)},
+		// Strava resets at midnight UTC, whatever the local zone
+		{nextMidnight, time.Date(2020, 7, 27, 23, 30, 0, 0, time.FixedZone("CEST", 2*3600)), time.Date(2020, 7, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := test.next(test.now); !got.Equal(test.want) {
+			t.Errorf("reset after %v = %v, want %v", test.now, got, test.want)
+		}
+	}
+}
+
+func TestRealtimeUsesWholeWindow(t *testing.T) {
+	l := &Limiter{BackfillReserve: 0.2}
+	for i := 0; i < DefaultShortLimit; i++ {
+		if delay := l.reserve(testNow, Realtime); delay != 0 {
+			t.Fatalf("request %v delayed by %v", i, delay)
+		}
+	}
+	if delay := l.reserve(testNow, Realtime); delay != 15*time.Minute {
+		t.Errorf("request over the limit delayed by %v, want until the window resets", delay)
+	}
+
+	// The next window starts empty
+	if delay := l.reserve(testNow.Add(15*time.Minute), Realtime); delay != 0 {
+		t.Errorf("request in the next window delayed by %v", delay)
+	}
+	if budget := l.Budget(); budget.ShortUsage != 1 || budget.DailyUsage != DefaultShortLimit+1 {
+		t.Errorf("usage %v/%v, want 1/%v", budget.ShortUsage, budget.DailyUsage, DefaultShortLimit+1)
+	}
+}
+
+func TestBackfillLeavesReserve(t *testing.T) {
+	l := &Limiter{BackfillReserve: 0.2}
+	for i := 0; i < DefaultShortLimit*80/100; i++ {
+		if delay := l.reserve(testNow, Realtime); delay != 0 {
+			t.Fatalf("request %v delayed by %v", i, delay)
+		}
+	}
+
+	// The last 20% of the window is left for realtime requests
+	if delay := l.reserve(testNow, Backfill); delay != 15*time.Minute {
+		t.Errorf("backfill request in the reserve delayed by %v, want until the window resets", delay)
+	}
+	if delay := l.reserve(testNow, Realtime); delay != 0 {
+		t.Errorf("realtime request delayed by %v", delay)
+	}
+}
+
+func TestBackfillIsSpread(t *testing.T) {
+	l := &Limiter{}
+	if delay := l.reserve(testNow, Backfill); delay != 0 {
+		t.Fatalf("first backfill request delayed by %v", delay)
+	}
+	// The remaining 99 requests are spread over 15 minutes
+	delay := l.reserve(testNow, Backfill)
+	if want := 15 * time.Minute / 99; delay != want {
+		t.Errorf("second backfill request delayed by %v, want %v", delay, want)
+	}
+	if delay := l.reserve(testNow, Realtime); delay != 0 {
+		t.Errorf("realtime request delayed by %v", delay)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	l := &Limiter{}
+	response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	response.Header.Set("X-RateLimit-Limit", "600,30000")
+	response.Header.Set("X-RateLimit-Usage", "10,500")
+	l.Update(response)
+	if budget := l.Budget(); budget.ShortLimit != 600 || budget.DailyLimit != 30000 || budget.ShortUsage != 10 || budget.DailyUsage != 500 {
+		t.Errorf("budget %+v does not match the headers", budget)
+	}
+
+	// A 429 spends the short window even when the usage lags behind
+	response = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	l.Update(response)
+	if budget := l.Budget(); budget.ShortUsage != budget.ShortLimit {
+		t.Errorf("usage %v after a 429, want %v", budget.ShortUsage, budget.ShortLimit)
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	l := &Limiter{}
+	response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	response.Header.Set("X-RateLimit-Usage", "100,1000")
+	l.Update(response)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, Realtime); err != context.DeadlineExceeded {
+		t.Errorf("Wait returned %v with the daily window spent, want %v", err, context.DeadlineExceeded)
+	}
+}
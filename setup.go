@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koding/multiconfig"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	"go-strava-daemon/classify"
+	"go-strava-daemon/config"
+	"go-strava-daemon/outboundhandler"
+	"go-strava-daemon/ratelimit"
+	"go-strava-daemon/storage"
+	"go-strava-daemon/stravaclient"
+	"go-strava-daemon/stravafake"
+	"go-strava-daemon/track"
+)
+
+// ReadSecret : Read a file and return it's content as string - used for Docker secrets
+func ReadSecret(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not fetch secret: %v", err)
+	}
+	return string(data), nil
+}
+
+// loadConfig : Load the configuration from the environment only, the arguments belong to the command
+func loadConfig() (*config.Config, error) {
+	conf := &config.Config{}
+	loader := &multiconfig.DefaultLoader{
+		Loader:    multiconfig.MultiLoader(&multiconfig.TagLoader{}, &multiconfig.EnvironmentLoader{}),
+		Validator: multiconfig.MultiValidator(&multiconfig.RequiredValidator{}),
+	}
+	if err := loader.Load(conf); err != nil {
+		return nil, fmt.Errorf("Could not load configuration: %v", err)
+	}
+	if err := loader.Validate(conf); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	return conf, nil
+}
+
+// configureLogging : Send the logs to stdout, a rotated file or both, as text or JSON
+func configureLogging(conf *config.Config) error {
+	switch conf.LogFormat {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %v, use text or json", conf.LogFormat)
+	}
+
+	// The directory of the log file is created when missing
+	file := &lumberjack.Logger{
+		Filename:   conf.LogFile,
+		MaxSize:    conf.LogMaxSize,
+		MaxBackups: conf.LogMaxBackups,
+		MaxAge:     conf.LogMaxAge,
+	}
+	switch conf.LogOutput {
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "file":
+		log.SetOutput(file)
+	case "both":
+		log.SetOutput(io.MultiWriter(os.Stdout, file))
+	default:
+		return fmt.Errorf("Unknown log output %v, use stdout, file or both", conf.LogOutput)
+	}
+	return nil
+}
+
+// configure : Check the configuration, read the production secrets and set up the conversion of activities
+func configure(conf *config.Config) (err error) {
+	if conf.FakeStrava && conf.DeploymentType == "production" {
+		return fmt.Errorf("The fake Strava API cannot be used in production")
+	}
+
+	// Check configuration type
+	if conf.DeploymentType == "production" {
+		secrets := []*string{&conf.PostgresPortEnv, &conf.PostgresHost, &conf.PostgresUser, &conf.PostgresPassword, &conf.PostgresDb, &conf.StravaClientID, &conf.StravaClientSecret}
+		for _, secret := range secrets {
+			if *secret, err = ReadSecret(*secret); err != nil {
+				return err
+			}
+		}
+		port, _ := strconv.ParseInt(strings.TrimSpace(conf.PostgresPortEnv), 10, 64)
+		conf.PostgresPort = port
+	} else if !conf.FakeStrava {
+		// The fake Strava API provides the callback URL and accepts the configured credentials
+		if conf.CallbackURL == "" || conf.StravaClientID == "" || conf.StravaClientSecret == "" {
+			return fmt.Errorf("Configuration not complete")
+		}
+	}
+	switch conf.Storage {
+	case "postgres":
+		if conf.DeploymentType != "production" && (conf.PostgresDb == "" || conf.PostgresHost == "" || conf.PostgresPassword == "" || conf.PostgresPort == 0 || conf.PostgresRequireSSL == "" || conf.PostgresUser == "") {
+			return fmt.Errorf("Postgres configuration not complete")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("Unknown storage %v, use postgres or memory", conf.Storage)
+	}
+
+	MaxActivities = conf.StravaMaxActivities
+	DeauthorizationPolicy = conf.DeauthorizationPolicy
+	if DeauthorizationPolicy != storage.PurgeDelete && DeauthorizationPolicy != storage.PurgeAnonymize {
+		return fmt.Errorf("Unknown deauthorization policy %v, use %v or %v", DeauthorizationPolicy, storage.PurgeDelete, storage.PurgeAnonymize)
+	}
+	ClassificationRules = classify.DefaultRules()
+	if conf.ClassificationRules != "" {
+		if ClassificationRules, err = classify.Load(conf.ClassificationRules); err != nil {
+			return fmt.Errorf("Could not load classification rules: %v", err)
+		}
+	}
+	PrivacyFilter = track.Privacy{Radius: conf.PrivacyRadius}
+
+	// Build the cleaning pipeline, stages are skipped when disabled
+	CleaningStages = nil
+	if conf.CleanMaxSpeed > 0 {
+		CleaningStages = append(CleaningStages, track.MaxSpeed{Limit: conf.CleanMaxSpeed})
+	}
+	if conf.CleanStopDuration > 0 {
+		CleaningStages = append(CleaningStages, track.Stops{
+			Radius:   conf.CleanStopRadius,
+			Duration: time.Duration(conf.CleanStopDuration) * time.Second,
+		})
+	}
+	if conf.CleanDuplicates {
+		CleaningStages = append(CleaningStages, track.Duplicates{Distance: conf.CleanDuplicateDistance})
+	}
+	MinTrackLength = track.MinLength{Distance: conf.CleanMinLength, Points: 2}
+	MaxPause = time.Duration(conf.SplitPause) * time.Second
+	Simplification = nil
+	if conf.SimplifyMethod != "" {
+		simplify, err := track.NewSimplify(conf.SimplifyMethod, conf.SimplifyTolerance)
+		if err != nil {
+			return fmt.Errorf("Could not configure simplification: %v", err)
+		}
+		Simplification = simplify
+	}
+	return nil
+}
+
+// connectStrava : Create the Strava clients and the subscription handler, the fake Strava API is started first when enabled
+func connectStrava(conf *config.Config) (fixtures stravafake.Fixtures) {
+	if conf.FakeStrava {
+		// Run against an in-process fake of the Strava API
+		log.Warn("CONFIG_FAKESTRAVA is set: the daemon talks to a FAKE Strava API, no data comes from or goes to Strava")
+		fixtures = startFakeStrava(conf)
+	}
+
+	// Pace all outgoing Strava requests
+	limiter = &ratelimit.Limiter{
+		BackfillReserve: conf.StravaBackfillReserve,
+	}
+	httpClient := &http.Client{}
+	stravaClient = &stravaclient.Client{
+		BaseURL:         conf.StravaAPIURL,
+		SubscriptionURL: conf.StravaWebhookURL,
+		ClientID:        conf.StravaClientID,
+		ClientSecret:    conf.StravaClientSecret,
+		HTTPClient:      httpClient,
+		Timeout:         time.Duration(conf.StravaTimeout) * time.Second,
+		Limiter:         limiter,
+		Priority:        ratelimit.Realtime,
+	}
+	// The backfill uses the same client with a lower priority
+	backfill := *stravaClient
+	backfill.Priority = ratelimit.Backfill
+	backfillClient = &backfill
+
+	verifyToken := conf.StravaVerifyToken
+	if verifyToken == "" {
+		// Generate a new token on restarting, it must not be guessable to forge the handshake
+		token := make([]byte, 32)
+		if _, err := rand.Read(token); err != nil {
+			log.Fatalf("Could not generate a verify token: %v", err)
+		}
+		verifyToken = hex.EncodeToString(token)
+	}
+	out = outboundhandler.StravaHandler{
+		CallbackURL: conf.CallbackURL,
+		VerifyToken: verifyToken,
+		Client:      stravaClient,
+		// A dry run must not replace the subscription of the production daemon
+		ReadOnly: conf.DryRun,
+	}
+	return
+}
+
+// openStorage : Connect to the configured storage, wrapped in a dry run when enabled
+func openStorage(conf *config.Config, fixtures stravafake.Fixtures) error {
+	switch conf.Storage {
+	case "postgres":
+		postgres := storage.Postgres{
+			Database: dbmodel.Database{
+				PostgresHost:       conf.PostgresHost,
+				PostgresUser:       conf.PostgresUser,
+				PostgresPassword:   conf.PostgresPassword,
+				PostgresPort:       conf.PostgresPort,
+				PostgresDb:         conf.PostgresDb,
+				PostgresRequireSSL: conf.PostgresRequireSSL,
+			},
+		}
+		postgres.VerifyConnection()
+		if err := postgres.CheckSchema(); err != nil {
+			return fmt.Errorf("Database schema not ready: %v", err)
+		}
+		db = postgres
+	case "memory":
+		memory := &storage.Memory{}
+		for _, user := range fakeStravaUsers(fixtures) {
+			memory.AddUser(user)
+		}
+		db = memory
+	default:
+		return fmt.Errorf("Unknown storage %v, use postgres or memory", conf.Storage)
+	}
+
+	// Keep contributions out of the store when trialling changes
+	if conf.DryRun {
+		var sink storage.ContributionSink = &storage.Memory{}
+		if conf.DryRunOutput != "" {
+			sink = &storage.FileSink{Path: conf.DryRunOutput}
+		}
+		db = &storage.DryRun{Source: db, Sink: sink}
+		log.Warnf("Dry run: contributions are written to %q, users are not updated", conf.DryRunOutput)
+	}
+	return nil
+}
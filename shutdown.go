@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// abortGrace : Part of the shutdown timeout the loops get to return after the work in flight was aborted
+const abortGrace = 2 * time.Second
+
+// waitForSignal : Block until SIGTERM or SIGINT is received
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	return <-signals
+}
+
+// shutdown : Stop accepting webhooks and starting new work, wait for the work in flight and put unprocessed queue entries back, all within the timeout
+func shutdown(server *http.Server, stop context.CancelFunc, abort context.CancelFunc, loops *sync.WaitGroup, timeout time.Duration) {
+	// Abort the work in flight early enough for the loops to return before the timeout
+	grace := abortGrace
+	if grace > timeout/2 {
+		grace = timeout / 2
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), timeout-grace)
+	defer cancel()
+
+	// The background loops return after their current activity or queue entry
+	stop()
+
+	// Webhook requests being handled are still written to the queue
+	if err := server.Shutdown(deadline); err != nil {
+		log.Warnf("Could not wait for the webhook requests in flight: %v", err)
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(returned)
+	}()
+	finished := true
+	select {
+	case <-returned:
+	case <-deadline.Done():
+		log.Warnf("Work in flight did not finish within %v, aborting it", timeout-grace)
+		abort()
+		select {
+		case <-returned:
+		case <-time.After(grace):
+			finished = false
+			log.Warn("Background loops did not return after aborting the work in flight, their queue entries are put back on the next start")
+		}
+	}
+
+	// Entries of workers that were aborted are processed again on the next start
+	// Entries of workers still running stay claimed, queue.Open releases them
+	if events != nil && finished {
+		if released, err := events.ReleaseClaimed(); err != nil {
+			log.Errorf("Could not put back claimed queue entries: %v", err)
+		} else if released > 0 {
+			log.Infof("Put back %v unprocessed queue entries", released)
+		}
+	}
+	log.Info("Shutdown complete")
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/track"
+)
+
+// DryRun : Store reading users from a source store, contributions go to a sink and all other writes stay in memory
+type DryRun struct {
+	Source Store
+	Sink   ContributionSink
+
+	mu            sync.Mutex
+	updated       map[string]dbmodel.User
+	fetched       map[string]bool
+	cursors       map[string]int64
+	subscriptions map[string]Subscription
+}
+
+// overlay : Apply the in-memory updates to a user read from the source
+func (d *DryRun) overlay(user dbmodel.User) dbmodel.User {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if updated, ok := d.updated[user.UserIdentifier]; ok {
+		user = updated
+	}
+	if d.fetched[user.ID] {
+		user.IsHistoryFetched = true
+	}
+	return user
+}
+
+// GetUserData : Get a user from the source store
+func (d *DryRun) GetUserData(providerUser string) (dbmodel.User, error) {
+	user, err := d.Source.GetUserData(providerUser)
+	if err != nil {
+		return user, err
+	}
+	return d.overlay(user), nil
+}
+
+// GetExpiringUsers : Get expiring users from the source store
+func (d *DryRun) GetExpiringUsers() (users []dbmodel.User, err error) {
+	source, err := d.Source.GetExpiringUsers()
+	for _, user := range source {
+		users = append(users, d.overlay(user))
+	}
+	return
+}
+
+// FetchNewUsers : Get new users from the source store, skipping users already handled in this run
+func (d *DryRun) FetchNewUsers() (users []dbmodel.User, err error) {
+	source, err := d.Source.FetchNewUsers()
+	for _, user := range source {
+		if user = d.overlay(user); !user.IsHistoryFetched {
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+// UpdateUser : Keep the update in memory
+func (d *DryRun) UpdateUser(user *dbmodel.User) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.updated == nil {
+		d.updated = map[string]dbmodel.User{}
+	}
+	d.updated[user.UserIdentifier] = *user
+	log.Infof("Dry run: not updating user %v", user.ID)
+	return nil
+}
+
+// MarkHistoryFetched : Keep the history state in memory
+func (d *DryRun) MarkHistoryFetched(userID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fetched == nil {
+		d.fetched = map[string]bool{}
+	}
+	d.fetched[userID] = true
+	log.Infof("Dry run: not marking the history of user %v as fetched", userID)
+	return nil
+}
+
+// SaveActivityContributions : Write the contributions to the sink
+func (d *DryRun) SaveActivityContributions(contributions []dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) (int, error) {
+	return d.Sink.SaveActivityContributions(contributions, user, activityID, timeSource)
+}
+
+// DeleteActivity : Remove the activity from the sink
+func (d *DryRun) DeleteActivity(activityID int64) (int, error) {
+	return d.Sink.DeleteActivity(activityID)
+}
+
+// RejectActivity : Record the rejection in the sink
+func (d *DryRun) RejectActivity(user *dbmodel.User, activityID int64, reason string) (int, error) {
+	return d.Sink.RejectActivity(user, activityID, reason)
+}
+
+// PurgeUser : Log the purge without touching the source store
+func (d *DryRun) PurgeUser(user *dbmodel.User, policy string, reason string) (int, error) {
+	log.Infof("Dry run: not purging user %v (policy %v, reason %v)", user.ID, policy, reason)
+	return 0, nil
+}
+
+// GetBackfillCursor : Get the cursor of this run, falling back to the source store
+func (d *DryRun) GetBackfillCursor(userID string) (int64, error) {
+	d.mu.Lock()
+	before, ok := d.cursors[userID]
+	d.mu.Unlock()
+	if ok {
+		return before, nil
+	}
+	return d.Source.GetBackfillCursor(userID)
+}
+
+// SaveBackfillCursor : Keep the cursor in memory
+func (d *DryRun) SaveBackfillCursor(userID string, before int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cursors == nil {
+		d.cursors = map[string]int64{}
+	}
+	d.cursors[userID] = before
+	return nil
+}
+
+// GetSubscription : Get the subscription saved during this run, falling back to the source store
+func (d *DryRun) GetSubscription(callbackURL string) (Subscription, error) {
+	d.mu.Lock()
+	subscription, ok := d.subscriptions[callbackURL]
+	d.mu.Unlock()
+	if ok {
+		return subscription, nil
+	}
+	return d.Source.GetSubscription(callbackURL)
+}
+
+// SaveSubscription : Keep the subscription in memory
+func (d *DryRun) SaveSubscription(subscription Subscription) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.subscriptions == nil {
+		d.subscriptions = map[string]Subscription{}
+	}
+	subscription.UpdatedAt = time.Now().UTC()
+	d.subscriptions[subscription.CallbackURL] = subscription
+	return nil
+}
+
+// Ping : Check that the source store is reachable
+func (d *DryRun) Ping(ctx context.Context) error {
+	return d.Source.Ping(ctx)
+}
+
+// GetPrivacyZones : Get the zones from the source store
+func (d *DryRun) GetPrivacyZones(userID string) ([]track.Zone, error) {
+	return d.Source.GetPrivacyZones(userID)
+}
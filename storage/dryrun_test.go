@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+)
+
+func TestDryRun(t *testing.T) {
+	source := &Memory{}
+	user := source.AddUser(testUser("1"))
+	sink := &Memory{}
+	d := &DryRun{Source: source, Sink: sink}
+
+	// Users are read from the source with the updates of this run applied
+	refreshed := user
+	refreshed.AccessToken = "refreshed"
+	if err := d.UpdateUser(&refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MarkHistoryFetched(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := d.GetUserData(user.ProviderUser); err != nil || stored.AccessToken != "refreshed" || !stored.IsHistoryFetched {
+		t.Errorf("user %+v (%v)", stored, err)
+	}
+	if users, err := d.FetchNewUsers(); err != nil || len(users) != 0 {
+		t.Errorf("new users %+v (%v)", users, err)
+	}
+	if stored, _ := source.GetUserData(user.ProviderUser); stored.AccessToken != "access-1" || stored.IsHistoryFetched {
+		t.Errorf("source user %+v was updated", stored)
+	}
+
+	// Contributions go to the sink
+	if _, err := d.SaveActivityContributions([]dbmodel.Contribution{{}}, &user, 1001, "streams"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.Contributions()) != 1 || len(source.Contributions()) != 0 {
+		t.Errorf("%v contributions in the sink, %v in the source", len(sink.Contributions()), len(source.Contributions()))
+	}
+
+	// Purges, cursors and subscriptions stay out of the source
+	if _, err := d.PurgeUser(&user, PurgeDelete, "deauthorized"); err != nil {
+		t.Fatal(err)
+	}
+	if len(source.Purges()) != 0 {
+		t.Errorf("purges %+v in the source", source.Purges())
+	}
+	source.SaveBackfillCursor(user.ID, 100)
+	if err := d.SaveBackfillCursor(user.ID, 50); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, _ := d.GetBackfillCursor(user.ID); cursor != 50 {
+		t.Errorf("cursor %v, want 50", cursor)
+	}
+	if cursor, _ := source.GetBackfillCursor(user.ID); cursor != 100 {
+		t.Errorf("source cursor %v, want 100", cursor)
+	}
+	if err := d.SaveSubscription(Subscription{CallbackURL: "http://callback", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if subscription, _ := d.GetSubscription("http://callback"); subscription.ID != 1 {
+		t.Errorf("subscription %+v", subscription)
+	}
+	if subscription, _ := source.GetSubscription("http://callback"); subscription.ID != 0 {
+		t.Errorf("source subscription %+v", subscription)
+	}
+}
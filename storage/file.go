@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+)
+
+// FileSink : ContributionSink appending every contribution as a GeoJSON feature on its own line (NDJSON)
+type FileSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// write : Append a line to the file
+func (f *FileSink) write(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open %v: %v", f.Path, err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// SaveActivityContributions : Append the contributions as GeoJSON LineString features, readers keep the last saved version of an activity
+func (f *FileSink) SaveActivityContributions(contributions []dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) (replaced int, err error) {
+	for _, contribution := range contributions {
+		if contribution.PointsGeom == nil {
+			return 0, fmt.Errorf("Contribution of activity %v has no geometry", activityID)
+		}
+	}
+	for i, contribution := range contributions {
+		feature := contribution.PointsGeom.ToGeoJSON()
+		feature.SetProperty("user_id", user.ID)
+		feature.SetProperty("activity_id", activityID)
+		feature.SetProperty("trip", i)
+		feature.SetProperty("trips", len(contributions))
+		feature.SetProperty("user_agent", contribution.UserAgent)
+		feature.SetProperty("distance", contribution.Distance)
+		feature.SetProperty("duration", contribution.Duration)
+		feature.SetProperty("timestamp_start", contribution.TimeStampStart)
+		feature.SetProperty("timestamp_stop", contribution.TimeStampStop)
+		feature.SetProperty("points_time", contribution.PointsTime)
+		feature.SetProperty("time_source", timeSource)
+		if err = f.write(feature); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RejectActivity : Append a rejection marker with the reason
+func (f *FileSink) RejectActivity(user *dbmodel.User, activityID int64, reason string) (deleted int, err error) {
+	err = f.write(map[string]interface{}{
+		"rejected_activity_id": activityID,
+		"user_id":              user.ID,
+		"reason":               reason,
+		"rejected_at":          time.Now().UTC(),
+	})
+	return
+}
+
+// DeleteActivity : Append a deletion marker, earlier lines are left untouched
+func (f *FileSink) DeleteActivity(activityID int64) (deleted int, err error) {
+	err = f.write(map[string]interface{}{
+		"deleted_activity_id": activityID,
+		"deleted_at":          time.Now().UTC(),
+	})
+	return
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+	geo "github.com/paulmach/go.geo"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := &FileSink{Path: filepath.Join(dir, "contributions.ndjson")}
+	user := &dbmodel.User{ID: "1"}
+
+	path := geo.NewPath()
+	path.Push(geo.NewPoint(3.7195, 51.0558))
+	path.Push(geo.NewPoint(3.7202, 51.0563))
+	if _, err := f.SaveActivityContributions([]dbmodel.Contribution{{PointsGeom: path, Distance: 80}}, user, 1001, "streams"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.RejectActivity(user, 1002, "private"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteActivity(1001); err != nil {
+		t.Fatal(err)
+	}
+
+	// Contributions without geometry are refused before anything is written
+	if _, err := f.SaveActivityContributions([]dbmodel.Contribution{{PointsGeom: path}, {}}, user, 1003, "streams"); err == nil {
+		t.Error("contribution without geometry accepted")
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("%v lines, want 3", len(lines))
+	}
+
+	feature := lines[0]
+	properties, _ := feature["properties"].(map[string]interface{})
+	geometry, _ := feature["geometry"].(map[string]interface{})
+	if feature["type"] != "Feature" || geometry["type"] != "LineString" {
+		t.Errorf("feature %v", feature)
+	}
+	if properties["activity_id"] != float64(1001) || properties["user_id"] != "1" || properties["time_source"] != "streams" || properties["trips"] != float64(1) {
+		t.Errorf("properties %v", properties)
+	}
+	if lines[1]["rejected_activity_id"] != float64(1002) || lines[1]["reason"] != "private" {
+		t.Errorf("rejection %v", lines[1])
+	}
+	if lines[2]["deleted_activity_id"] != float64(1001) {
+		t.Errorf("deletion %v", lines[2])
+	}
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	"go-strava-daemon/track"
+)
+
+// MemoryContribution : Contribution kept by the Memory store
+type MemoryContribution struct {
+	Contribution dbmodel.Contribution
+	UserID       string
+	ActivityID   int64
+	TimeSource   string
+}
+
+// MemoryPurge : Audit log entry kept by the Memory store
+type MemoryPurge struct {
+	UserID        string
+	ProviderUser  string
+	Reason        string
+	Policy        string
+	Contributions int
+	PurgedAt      time.Time
+}
+
+// MemoryRejection : Rejected activity kept by the Memory store
+type MemoryRejection struct {
+	UserID     string
+	ActivityID int64
+	Reason     string
+	RejectedAt time.Time
+}
+
+// Memory : In-memory Store, used for local runs against the fake Strava API
+type Memory struct {
+	mu            sync.Mutex
+	users         []dbmodel.User
+	contributions []MemoryContribution
+	purges        []MemoryPurge
+	rejections    []MemoryRejection
+	cursors       map[string]int64
+	zones         map[string][]track.Zone
+	subscriptions map[string]Subscription
+	nextID        int
+}
+
+// newID : Generate a new identifier, must be called with the lock held
+func (m *Memory) newID() string {
+	m.nextID++
+	return strconv.Itoa(m.nextID)
+}
+
+// AddUser : Add a user, an ID is assigned when it has none
+func (m *Memory) AddUser(user dbmodel.User) dbmodel.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user.ID == "" {
+		user.ID = m.newID()
+	}
+	m.users = append(m.users, user)
+	return user
+}
+
+// AddPrivacyZone : Declare a zone of a user in which no points are stored
+func (m *Memory) AddPrivacyZone(userID string, zone track.Zone) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.zones == nil {
+		m.zones = map[string][]track.Zone{}
+	}
+	m.zones[userID] = append(m.zones[userID], zone)
+}
+
+// Contributions : Snapshot of the stored contributions
+func (m *Memory) Contributions() []MemoryContribution {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MemoryContribution{}, m.contributions...)
+}
+
+// Purges : Snapshot of the purge audit log
+func (m *Memory) Purges() []MemoryPurge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MemoryPurge{}, m.purges...)
+}
+
+// Rejections : Snapshot of the rejected activities
+func (m *Memory) Rejections() []MemoryRejection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MemoryRejection{}, m.rejections...)
+}
+
+// GetUserData : Get a user by their Strava athlete ID
+func (m *Memory) GetUserData(providerUser string) (dbmodel.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.ProviderUser == providerUser {
+			return user, nil
+		}
+	}
+	return dbmodel.User{}, sql.ErrNoRows
+}
+
+// GetExpiringUsers : Get users whose access token expires within half an hour
+func (m *Memory) GetExpiringUsers() (users []dbmodel.User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit := int(time.Now().Add(30 * time.Minute).Unix())
+	for _, user := range m.users {
+		if user.ExpiresAt <= limit && user.RefreshToken != "" {
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+// FetchNewUsers : Get users whose history has not been fetched yet
+func (m *Memory) FetchNewUsers() (users []dbmodel.User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if !user.IsHistoryFetched {
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+// UpdateUser : Update the tokens and history state of a user
+func (m *Memory) UpdateUser(user *dbmodel.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.users {
+		if existing.UserIdentifier == user.UserIdentifier {
+			m.users[i].ExpiresAt = user.ExpiresAt
+			m.users[i].ExpiresIn = user.ExpiresIn
+			m.users[i].AccessToken = user.AccessToken
+			m.users[i].RefreshToken = user.RefreshToken
+			m.users[i].IsHistoryFetched = user.IsHistoryFetched
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown user %v", user.UserIdentifier)
+}
+
+// MarkHistoryFetched : Mark the history of a user as fetched without touching the tokens, purged users are skipped
+func (m *Memory) MarkHistoryFetched(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.users {
+		if existing.ID == userID {
+			if existing.RefreshToken != "" {
+				m.users[i].IsHistoryFetched = true
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown user %v", userID)
+}
+
+// deleteActivity : Remove all contributions created from a Strava activity, must be called with the lock held
+func (m *Memory) deleteActivity(activityID int64) (deleted int) {
+	kept := m.contributions[:0]
+	for _, contribution := range m.contributions {
+		if contribution.ActivityID == activityID {
+			deleted++
+			continue
+		}
+		kept = append(kept, contribution)
+	}
+	m.contributions = kept
+	return
+}
+
+// SaveActivityContributions : Replace the contributions created from a Strava activity, saving an activity again never duplicates it
+func (m *Memory) SaveActivityContributions(contributions []dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) (replaced int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	replaced = m.deleteActivity(activityID)
+	for i := range contributions {
+		contributions[i].ContributionID = m.newID()
+		m.contributions = append(m.contributions, MemoryContribution{
+			Contribution: contributions[i],
+			UserID:       user.ID,
+			ActivityID:   activityID,
+			TimeSource:   timeSource,
+		})
+	}
+
+	// The activity is no longer rejected
+	rejections := m.rejections[:0]
+	for _, rejection := range m.rejections {
+		if rejection.ActivityID != activityID {
+			rejections = append(rejections, rejection)
+		}
+	}
+	m.rejections = rejections
+	return
+}
+
+// DeleteActivity : Remove all contributions created from a Strava activity
+func (m *Memory) DeleteActivity(activityID int64) (deleted int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteActivity(activityID), nil
+}
+
+// RejectActivity : Remove the contributions of a Strava activity and record why it was not turned into a contribution, replacing an earlier reason
+func (m *Memory) RejectActivity(user *dbmodel.User, activityID int64, reason string) (deleted int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted = m.deleteActivity(activityID)
+	rejection := MemoryRejection{
+		UserID:     user.ID,
+		ActivityID: activityID,
+		Reason:     reason,
+		RejectedAt: time.Now().UTC(),
+	}
+	for i, existing := range m.rejections {
+		if existing.ActivityID == activityID {
+			m.rejections[i] = rejection
+			return
+		}
+	}
+	m.rejections = append(m.rejections, rejection)
+	return
+}
+
+// PurgeUser : Wipe the tokens of a user and delete or anonymize their contributions
+func (m *Memory) PurgeUser(user *dbmodel.User, policy string, reason string) (affected int, err error) {
+	if policy != PurgeDelete && policy != PurgeAnonymize {
+		err = fmt.Errorf("Unknown retention policy %v", policy)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.users {
+		if existing.ID == user.ID {
+			m.users[i].AccessToken = ""
+			m.users[i].RefreshToken = ""
+			m.users[i].ExpiresAt = 0
+			m.users[i].ExpiresIn = 0
+			m.users[i].IsHistoryFetched = true
+		}
+	}
+
+	kept := m.contributions[:0]
+	for _, contribution := range m.contributions {
+		if contribution.UserID == user.ID {
+			affected++
+			if policy == PurgeDelete {
+				continue
+			}
+			contribution.UserID = ""
+			contribution.ActivityID = 0
+		}
+		kept = append(kept, contribution)
+	}
+	m.contributions = kept
+	delete(m.cursors, user.ID)
+	delete(m.zones, user.ID)
+
+	rejections := m.rejections[:0]
+	for _, rejection := range m.rejections {
+		if rejection.UserID != user.ID {
+			rejections = append(rejections, rejection)
+		}
+	}
+	m.rejections = rejections
+
+	m.purges = append(m.purges, MemoryPurge{
+		UserID:        user.ID,
+		ProviderUser:  user.ProviderUser,
+		Reason:        reason,
+		Policy:        policy,
+		Contributions: affected,
+		PurgedAt:      time.Now().UTC(),
+	})
+	return
+}
+
+// GetBackfillCursor : Start (epoch) of the oldest activity handled by the history backfill, 0 when it has not started
+func (m *Memory) GetBackfillCursor(userID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cursors[userID], nil
+}
+
+// SaveBackfillCursor : Persist the history backfill progress of a user
+func (m *Memory) SaveBackfillCursor(userID string, before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cursors == nil {
+		m.cursors = map[string]int64{}
+	}
+	m.cursors[userID] = before
+	return nil
+}
+
+// GetSubscription : Get the subscription of a callback URL, empty when none was saved
+func (m *Memory) GetSubscription(callbackURL string) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.subscriptions[callbackURL], nil
+}
+
+// SaveSubscription : Persist the subscription of its callback URL
+func (m *Memory) SaveSubscription(subscription Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = map[string]Subscription{}
+	}
+	subscription.UpdatedAt = time.Now().UTC()
+	m.subscriptions[subscription.CallbackURL] = subscription
+	return nil
+}
+
+// Ping : The memory store is always reachable
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// GetPrivacyZones : Get the zones declared by a user in which no points are stored
+func (m *Memory) GetPrivacyZones(userID string) ([]track.Zone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]track.Zone{}, m.zones[userID]...), nil
+}
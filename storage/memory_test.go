@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+)
+
+// testUser : User with tokens expiring in six hours and a pending backfill
+func testUser(identifier string) dbmodel.User {
+	return dbmodel.User{
+		UserIdentifier: identifier,
+		Provider:       "web/Strava",
+		ProviderUser:   identifier,
+		AccessToken:    "access-" + identifier,
+		RefreshToken:   "refresh-" + identifier,
+		ExpiresAt:      int(time.Now().Add(6 * time.Hour).Unix()),
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	m := &Memory{}
+	user := m.AddUser(testUser("1"))
+	expiring := testUser("2")
+	expiring.ExpiresAt = int(time.Now().Unix())
+	expiring = m.AddUser(expiring)
+
+	if users, err := m.GetExpiringUsers(); err != nil || len(users) != 1 || users[0].ID != expiring.ID {
+		t.Errorf("expiring users %+v (%v)", users, err)
+	}
+	if users, err := m.FetchNewUsers(); err != nil || len(users) != 2 {
+		t.Errorf("new users %+v (%v)", users, err)
+	}
+
+	// Marking the history leaves the tokens alone
+	user.AccessToken = "stale"
+	if err := m.MarkHistoryFetched(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := m.GetUserData(user.ProviderUser)
+	if err != nil || !stored.IsHistoryFetched || stored.AccessToken != "access-1" {
+		t.Errorf("user %+v (%v)", stored, err)
+	}
+	if users, err := m.FetchNewUsers(); err != nil || len(users) != 1 || users[0].ID != expiring.ID {
+		t.Errorf("new users %+v (%v)", users, err)
+	}
+	if err := m.MarkHistoryFetched("unknown"); err == nil {
+		t.Error("unknown user marked")
+	}
+
+	// Updating the tokens keeps a pending backfill pending
+	expiring.AccessToken = "refreshed"
+	expiring.ExpiresAt = int(time.Now().Add(6 * time.Hour).Unix())
+	if err := m.UpdateUser(&expiring); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := m.GetUserData(expiring.ProviderUser); err != nil || stored.AccessToken != "refreshed" || stored.IsHistoryFetched {
+		t.Errorf("user %+v (%v)", stored, err)
+	}
+	if users, err := m.GetExpiringUsers(); err != nil || len(users) != 0 {
+		t.Errorf("expiring users %+v (%v)", users, err)
+	}
+}
+
+func TestMemoryContributions(t *testing.T) {
+	m := &Memory{}
+	user := m.AddUser(testUser("1"))
+
+	if _, err := m.RejectActivity(&user, 1001, "too short"); err != nil {
+		t.Fatal(err)
+	}
+	contributions := []dbmodel.Contribution{{Distance: 100}, {Distance: 200}}
+	if replaced, err := m.SaveActivityContributions(contributions, &user, 1001, "streams"); err != nil || replaced != 0 {
+		t.Fatalf("replaced %v (%v)", replaced, err)
+	}
+	if rejections := m.Rejections(); len(rejections) != 0 {
+		t.Errorf("rejections %+v kept after saving the activity", rejections)
+	}
+
+	// Saving again replaces the contributions
+	if replaced, err := m.SaveActivityContributions(contributions[:1], &user, 1001, "polyline"); err != nil || replaced != 2 {
+		t.Errorf("replaced %v (%v), want 2", replaced, err)
+	}
+	stored := m.Contributions()
+	if len(stored) != 1 || stored[0].TimeSource != "polyline" || stored[0].UserID != user.ID || stored[0].ActivityID != 1001 {
+		t.Errorf("contributions %+v", stored)
+	}
+
+	// Rejecting removes the contributions
+	if deleted, err := m.RejectActivity(&user, 1001, "private"); err != nil || deleted != 1 {
+		t.Errorf("deleted %v (%v), want 1", deleted, err)
+	}
+	if rejections := m.Rejections(); len(rejections) != 1 || rejections[0].Reason != "private" {
+		t.Errorf("rejections %+v", rejections)
+	}
+	if deleted, err := m.DeleteActivity(1001); err != nil || deleted != 0 {
+		t.Errorf("deleted %v (%v), want 0", deleted, err)
+	}
+}
+
+func TestMemoryPurgeUser(t *testing.T) {
+	for _, policy := range []string{PurgeDelete, PurgeAnonymize} {
+		m := &Memory{}
+		user := m.AddUser(testUser("1"))
+		other := m.AddUser(testUser("2"))
+		m.SaveActivityContributions([]dbmodel.Contribution{{}, {}}, &user, 1001, "streams")
+		m.SaveActivityContributions([]dbmodel.Contribution{{}}, &other, 2001, "streams")
+		m.SaveBackfillCursor(user.ID, 1595230200)
+
+		affected, err := m.PurgeUser(&user, policy, "deauthorized")
+		if err != nil || affected != 2 {
+			t.Fatalf("%v: affected %v (%v), want 2", policy, affected, err)
+		}
+		stored, _ := m.GetUserData(user.ProviderUser)
+		if stored.AccessToken != "" || stored.RefreshToken != "" || !stored.IsHistoryFetched {
+			t.Errorf("%v: purged user %+v", policy, stored)
+		}
+		if cursor, _ := m.GetBackfillCursor(user.ID); cursor != 0 {
+			t.Errorf("%v: cursor %v kept", policy, cursor)
+		}
+
+		want := map[string]int{PurgeDelete: 1, PurgeAnonymize: 3}[policy]
+		if contributions := m.Contributions(); len(contributions) != want {
+			t.Errorf("%v: %v contributions left, want %v", policy, len(contributions), want)
+		}
+		for _, contribution := range m.Contributions() {
+			if contribution.UserID == user.ID || contribution.ActivityID == 1001 {
+				t.Errorf("%v: contribution %+v still linked to the user", policy, contribution)
+			}
+		}
+		if purges := m.Purges(); len(purges) != 1 || purges[0].Policy != policy || purges[0].Contributions != 2 {
+			t.Errorf("%v: purges %+v", policy, purges)
+		}
+
+		// A purged user is never picked up again
+		if err := m.MarkHistoryFetched(user.ID); err != nil {
+			t.Fatal(err)
+		}
+		if users, _ := m.GetExpiringUsers(); len(users) != 0 {
+			t.Errorf("%v: expiring users %+v", policy, users)
+		}
+	}
+
+	m := &Memory{}
+	user := m.AddUser(testUser("1"))
+	if _, err := m.PurgeUser(&user, "keep", "deauthorized"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
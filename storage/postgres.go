@@ -0,0 +1,507 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+	"github.com/lib/pq"
+
+	"go-strava-daemon/track"
+)
+
+// Postgres : Extends dbmodel.Database with the queries this daemon needs on top of the shared library
+type Postgres struct {
+	dbmodel.Database
+}
+
+// connectionString : Generate connectionstring
+func (db Postgres) connectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%v", db.PostgresHost, db.PostgresPort, db.PostgresUser, db.PostgresPassword, db.PostgresDb, db.PostgresRequireSSL)
+}
+
+// connect : Open a connection to the database
+func (db Postgres) connect() (*sql.DB, error) {
+	connection, err := sql.Open("postgres", db.connectionString())
+	if err != nil {
+		return nil, fmt.Errorf("Could not create database connection: %v", err)
+	}
+	return connection, nil
+}
+
+// schemaTables : Tables of this daemon, created by the owner of the shared database with storage/schema.sql
+var schemaTables = []string{"StravaActivities", "DataPurges", "StravaBackfill", "StravaRejectedActivities", "PrivacyZones", "StravaSubscriptions"}
+
+// CheckSchema : Check that the tables of this daemon exist, the daemon never changes the shared schema itself
+func (db Postgres) CheckSchema() error {
+	connection, err := db.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	var missing []string
+	for _, table := range schemaTables {
+		var exists bool
+		if err := connection.QueryRow(`SELECT to_regclass($1) IS NOT NULL;`, fmt.Sprintf(`"%v"`, table)).Scan(&exists); err != nil {
+			return fmt.Errorf("Could not check table %v: %v", table, err)
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Tables %v are missing, the owner of the database creates them with storage/schema.sql", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Ping : Check that the database accepts connections
+func (db Postgres) Ping(ctx context.Context) error {
+	connection, err := db.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if err := connection.PingContext(ctx); err != nil {
+		return fmt.Errorf("Database is unreachable: %v", err)
+	}
+	return nil
+}
+
+// GetPrivacyZones : Get the zones declared by a user in which no points are stored
+func (db Postgres) GetPrivacyZones(userID string) (zones []track.Zone, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	response, err := connection.Query(`
+	SELECT "Latitude", "Longitude", "Radius" FROM "PrivacyZones"
+	WHERE "UserId" = $1;
+	`, userID)
+	if err != nil {
+		return
+	}
+	defer response.Close()
+
+	for response.Next() {
+		var zone track.Zone
+		if err = response.Scan(&zone.Latitude, &zone.Longitude, &zone.Radius); err != nil {
+			return
+		}
+		zones = append(zones, zone)
+	}
+	err = response.Err()
+	return
+}
+
+// GetBackfillCursor : Start (epoch) of the oldest activity handled by the history backfill, 0 when it has not started
+func (db Postgres) GetBackfillCursor(userID string) (before int64, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	err = connection.QueryRow(`SELECT "Before" FROM "StravaBackfill" WHERE "UserId" = $1;`, userID).Scan(&before)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SaveBackfillCursor : Persist the history backfill progress of a user
+func (db Postgres) SaveBackfillCursor(userID string, before int64) error {
+	connection, err := db.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	_, err = connection.Exec(`
+	INSERT INTO "StravaBackfill" ("UserId", "Before", "UpdatedAt")
+	VALUES ($1, $2, $3)
+	ON CONFLICT ("UserId") DO UPDATE SET "Before" = EXCLUDED."Before", "UpdatedAt" = EXCLUDED."UpdatedAt";
+	`, userID, before, time.Now().UTC())
+	return err
+}
+
+// GetSubscription : Get the subscription of a callback URL, empty when none was saved
+func (db Postgres) GetSubscription(callbackURL string) (subscription Subscription, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	err = connection.QueryRow(`
+	SELECT "CallbackUrl", "SubscriptionId", "VerifyToken", "UpdatedAt" FROM "StravaSubscriptions"
+	WHERE "CallbackUrl" = $1;
+	`, callbackURL).Scan(&subscription.CallbackURL, &subscription.ID, &subscription.VerifyToken, &subscription.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SaveSubscription : Persist the subscription of its callback URL
+func (db Postgres) SaveSubscription(subscription Subscription) error {
+	connection, err := db.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	_, err = connection.Exec(`
+	INSERT INTO "StravaSubscriptions" ("CallbackUrl", "SubscriptionId", "VerifyToken", "UpdatedAt")
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT ("CallbackUrl") DO UPDATE SET "SubscriptionId" = EXCLUDED."SubscriptionId", "VerifyToken" = EXCLUDED."VerifyToken", "UpdatedAt" = EXCLUDED."UpdatedAt";
+	`, subscription.CallbackURL, subscription.ID, subscription.VerifyToken, time.Now().UTC())
+	return err
+}
+
+// GetExpiringUsers : Get users which are expiring within half an hour, skipping users whose tokens were wiped
+// The history state is selected as well, saving the refreshed tokens must not mark a paused backfill as done
+func (db Postgres) GetExpiringUsers() (users []dbmodel.User, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	// Fetch expiring users
+	response, err := connection.Query(`
+	SELECT "Id", "RefreshToken", "UserIdentifier", "IsHistoryFetched" FROM "Users"
+	WHERE "ExpiresAt" <= $1 AND "Provider" = 'web/Strava' AND "RefreshToken" <> '';
+	`, time.Now().Add(30*time.Minute).Unix())
+	if err != nil {
+		return
+	}
+	defer response.Close()
+
+	// Convert sql.Rows into User objects
+	for response.Next() {
+		var user dbmodel.User
+		if err = response.Scan(&user.ID, &user.RefreshToken, &user.UserIdentifier, &user.IsHistoryFetched); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	err = response.Err()
+	return
+}
+
+// MarkHistoryFetched : Mark the history of a user as fetched without touching the tokens, purged users are skipped
+func (db Postgres) MarkHistoryFetched(userID string) error {
+	connection, err := db.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	if _, err := connection.Exec(`
+	UPDATE "Users" SET "IsHistoryFetched" = true
+	WHERE "Id"::text = $1 AND "RefreshToken" <> '';
+	`, userID); err != nil {
+		return fmt.Errorf("Could not mark the history of user %v as fetched: %v", userID, err)
+	}
+	return nil
+}
+
+// PurgeUser : Wipe the tokens of a user and delete or anonymize their contributions, the purge is recorded in the audit log
+func (db Postgres) PurgeUser(user *dbmodel.User, policy string, reason string) (affected int, err error) {
+	if policy != PurgeDelete && policy != PurgeAnonymize {
+		err = fmt.Errorf("Unknown retention policy %v", policy)
+		return
+	}
+
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	tx, err := connection.Begin()
+	if err != nil {
+		err = fmt.Errorf("Could not start transaction: %v", err)
+		return
+	}
+
+	// Wipe tokens so the subscription is no longer refreshed
+	if _, err = tx.Exec(`
+	UPDATE "Users"
+	SET "AccessToken" = '',
+		"RefreshToken" = '',
+		"ExpiresAt" = 0,
+		"ExpiresIn" = 0,
+		"IsHistoryFetched" = true
+	WHERE "Id"::text = $1;
+	`, user.ID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not wipe tokens of user %v: %v", user.ID, err)
+		return
+	}
+
+	// Unlink the contributions from the user
+	rows, err := tx.Query(`
+	DELETE FROM "UserContributions"
+	WHERE "UserId"::text = $1
+	RETURNING "ContributionId"::text;
+	`, user.ID)
+	if err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not unlink contributions of user %v: %v", user.ID, err)
+		return
+	}
+	var contributionIDs []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return
+		}
+		contributionIDs = append(contributionIDs, id)
+	}
+	rows.Close()
+
+	if _, err = tx.Exec(`DELETE FROM "StravaBackfill" WHERE "UserId" = $1;`, user.ID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not delete backfill cursor of user %v: %v", user.ID, err)
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM "StravaActivities" WHERE "UserId" = $1;`, user.ID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not unlink activities of user %v: %v", user.ID, err)
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM "StravaRejectedActivities" WHERE "UserId" = $1;`, user.ID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not delete rejected activities of user %v: %v", user.ID, err)
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM "PrivacyZones" WHERE "UserId" = $1;`, user.ID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not delete privacy zones of user %v: %v", user.ID, err)
+		return
+	}
+
+	// Anonymized contributions are kept without any link to the user
+	if policy == PurgeDelete {
+		for _, id := range contributionIDs {
+			if _, err = tx.Exec(`DELETE FROM "Contributions" WHERE "ContributionId"::text = $1;`, id); err != nil {
+				tx.Rollback()
+				err = fmt.Errorf("Could not delete contribution %v: %v", id, err)
+				return
+			}
+		}
+	}
+
+	// Write audit log entry
+	if _, err = tx.Exec(`
+	INSERT INTO "DataPurges"
+	("UserId", "ProviderUser", "Reason", "Policy", "Contributions", "PurgedAt")
+	VALUES ($1, $2, $3, $4, $5, $6);
+	`, user.ID, user.ProviderUser, reason, policy, len(contributionIDs), time.Now().UTC()); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not write purge audit log: %v", err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = fmt.Errorf("Could not commit purge of user %v: %v", user.ID, err)
+		return
+	}
+	affected = len(contributionIDs)
+	return
+}
+
+// lockActivity : Start a transaction holding a lock on the activity, concurrent writers of the same activity wait for each other
+func (db Postgres) lockActivity(connection *sql.DB, activityID int64) (*sql.Tx, error) {
+	tx, err := connection.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("Could not start transaction: %v", err)
+	}
+	// The lock is released when the transaction ends
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1);`, activityID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("Could not lock activity %v: %v", activityID, err)
+	}
+	return tx, nil
+}
+
+// deleteActivityContributions : Remove all contributions linked to a Strava activity within a transaction
+func deleteActivityContributions(tx *sql.Tx, activityID int64) (deleted int, err error) {
+	// Fetch linked contributions
+	rows, err := tx.Query(`
+	DELETE FROM "StravaActivities"
+	WHERE "ActivityId" = $1
+	RETURNING "ContributionId";
+	`, activityID)
+	if err != nil {
+		err = fmt.Errorf("Could not fetch contributions of activity %v: %v", activityID, err)
+		return
+	}
+	var contributionIDs []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return
+		}
+		contributionIDs = append(contributionIDs, id)
+	}
+	rows.Close()
+
+	// Delete the contributions and their link to the user
+	for _, id := range contributionIDs {
+		if _, err = tx.Exec(`DELETE FROM "UserContributions" WHERE "ContributionId"::text = $1;`, id); err != nil {
+			err = fmt.Errorf("Could not delete user contribution %v: %v", id, err)
+			return
+		}
+		if _, err = tx.Exec(`DELETE FROM "Contributions" WHERE "ContributionId"::text = $1;`, id); err != nil {
+			err = fmt.Errorf("Could not delete contribution %v: %v", id, err)
+			return
+		}
+	}
+	deleted = len(contributionIDs)
+	return
+}
+
+// insertActivityContribution : Create new user contribution and link it to the Strava activity it originates from within a transaction
+func insertActivityContribution(tx *sql.Tx, contribution *dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) error {
+	// Write Contribution
+	response := tx.QueryRow(`
+	INSERT INTO "Contributions"
+	("UserAgent", "Distance", "TimeStampStart", "TimeStampStop", "Duration", "PointsGeom", "PointsTime")
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING "ContributionId";
+	`, contribution.UserAgent, contribution.Distance, contribution.TimeStampStart, contribution.TimeStampStop, contribution.Duration, contribution.PointsGeom.ToWKT(), pq.Array(contribution.PointsTime))
+	if err := response.Scan(&contribution.ContributionID); err != nil {
+		return fmt.Errorf("Could not extract contributionID: %v", err)
+	}
+
+	// Write UserContribution
+	if _, err := tx.Exec(`
+	INSERT INTO "UserContributions"
+	("UserId", "ContributionId")
+	VALUES ($1, $2);
+	`, user.ID, contribution.ContributionID); err != nil {
+		return fmt.Errorf("Could not insert value into user contributions: %v", err)
+	}
+
+	// Write link to the Strava activity
+	if _, err := tx.Exec(`
+	INSERT INTO "StravaActivities"
+	("ActivityId", "ContributionId", "UserId", "TimeSource")
+	VALUES ($1, $2, $3, $4);
+	`, activityID, contribution.ContributionID, user.ID, timeSource); err != nil {
+		return fmt.Errorf("Could not link contribution to activity %v: %v", activityID, err)
+	}
+	return nil
+}
+
+// SaveActivityContributions : Replace the contributions of a Strava activity in one transaction, saving an activity again never duplicates it
+func (db Postgres) SaveActivityContributions(contributions []dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) (replaced int, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	tx, err := db.lockActivity(connection, activityID)
+	if err != nil {
+		return
+	}
+
+	// Remove the earlier version of the activity
+	if replaced, err = deleteActivityContributions(tx, activityID); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	for i := range contributions {
+		if err = insertActivityContribution(tx, &contributions[i], user, activityID, timeSource); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	// The activity is no longer rejected
+	if _, err = tx.Exec(`DELETE FROM "StravaRejectedActivities" WHERE "ActivityId" = $1;`, activityID); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not clear rejection of activity %v: %v", activityID, err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = fmt.Errorf("Could not commit contributions of activity %v: %v", activityID, err)
+	}
+	return
+}
+
+// DeleteActivity : Remove all contributions created from a Strava activity
+func (db Postgres) DeleteActivity(activityID int64) (deleted int, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	tx, err := db.lockActivity(connection, activityID)
+	if err != nil {
+		return
+	}
+
+	if deleted, err = deleteActivityContributions(tx, activityID); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = fmt.Errorf("Could not commit deletion of activity %v: %v", activityID, err)
+	}
+	return
+}
+
+// RejectActivity : Remove the contributions of a Strava activity and record why it was not turned into a contribution, replacing an earlier reason
+func (db Postgres) RejectActivity(user *dbmodel.User, activityID int64, reason string) (deleted int, err error) {
+	connection, err := db.connect()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	tx, err := db.lockActivity(connection, activityID)
+	if err != nil {
+		return
+	}
+
+	if deleted, err = deleteActivityContributions(tx, activityID); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if _, err = tx.Exec(`
+	INSERT INTO "StravaRejectedActivities" ("ActivityId", "UserId", "Reason", "RejectedAt")
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT ("ActivityId") DO UPDATE SET "Reason" = EXCLUDED."Reason", "RejectedAt" = EXCLUDED."RejectedAt";
+	`, activityID, user.ID, reason, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		err = fmt.Errorf("Could not record rejection of activity %v: %v", activityID, err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		err = fmt.Errorf("Could not commit rejection of activity %v: %v", activityID, err)
+	}
+	return
+}
@@ -0,0 +1,76 @@
+-- Tables of go-strava-daemon in the shared database
+-- Run by the owner of the schema before deploying the daemon, the daemon only checks that the tables exist
+-- Running the script again only adds what is missing
+
+-- Link between Strava activities and the contributions created from them, removed together with the contribution
+DO $$
+DECLARE
+	contribution_type TEXT;
+BEGIN
+	-- The foreign key needs the type of the contribution IDs
+	SELECT format_type(atttypid, atttypmod) INTO contribution_type
+	FROM pg_attribute
+	WHERE attrelid = '"Contributions"'::regclass AND attname = 'ContributionId';
+
+	EXECUTE format('
+	CREATE TABLE IF NOT EXISTS "StravaActivities" (
+		"ActivityId" BIGINT NOT NULL,
+		"ContributionId" %s NOT NULL,
+		"UserId" TEXT NOT NULL,
+		"TimeSource" TEXT NOT NULL DEFAULT '''',
+		PRIMARY KEY ("ActivityId", "ContributionId")
+	);', contribution_type);
+	ALTER TABLE "StravaActivities" ADD COLUMN IF NOT EXISTS "TimeSource" TEXT NOT NULL DEFAULT '';
+
+	-- Tables created by earlier versions of the daemon store the ID as text without a foreign key
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'StravaActivities_ContributionId_fkey') THEN
+		DELETE FROM "StravaActivities"
+		WHERE "ContributionId"::text NOT IN (SELECT "ContributionId"::text FROM "Contributions");
+		EXECUTE format('ALTER TABLE "StravaActivities" ALTER COLUMN "ContributionId" TYPE %s USING "ContributionId"::%s;', contribution_type, contribution_type);
+		ALTER TABLE "StravaActivities" ADD CONSTRAINT "StravaActivities_ContributionId_fkey"
+			FOREIGN KEY ("ContributionId") REFERENCES "Contributions" ("ContributionId") ON DELETE CASCADE;
+	END IF;
+END $$;
+
+-- Audit log of user data purges
+CREATE TABLE IF NOT EXISTS "DataPurges" (
+	"Id" BIGSERIAL PRIMARY KEY,
+	"UserId" TEXT NOT NULL,
+	"ProviderUser" TEXT NOT NULL,
+	"Reason" TEXT NOT NULL,
+	"Policy" TEXT NOT NULL,
+	"Contributions" INTEGER NOT NULL,
+	"PurgedAt" TIMESTAMPTZ NOT NULL
+);
+
+-- Progress of the history backfill per user
+CREATE TABLE IF NOT EXISTS "StravaBackfill" (
+	"UserId" TEXT PRIMARY KEY,
+	"Before" BIGINT NOT NULL,
+	"UpdatedAt" TIMESTAMPTZ NOT NULL
+);
+
+-- Activities dropped by the classification rules
+CREATE TABLE IF NOT EXISTS "StravaRejectedActivities" (
+	"ActivityId" BIGINT PRIMARY KEY,
+	"UserId" TEXT NOT NULL,
+	"Reason" TEXT NOT NULL,
+	"RejectedAt" TIMESTAMPTZ NOT NULL
+);
+
+-- Zones declared by users in which no points are stored
+CREATE TABLE IF NOT EXISTS "PrivacyZones" (
+	"Id" BIGSERIAL PRIMARY KEY,
+	"UserId" TEXT NOT NULL,
+	"Latitude" DOUBLE PRECISION NOT NULL,
+	"Longitude" DOUBLE PRECISION NOT NULL,
+	"Radius" DOUBLE PRECISION NOT NULL
+);
+
+-- Webhook subscription shared by the instances answering a callback URL
+CREATE TABLE IF NOT EXISTS "StravaSubscriptions" (
+	"CallbackUrl" TEXT PRIMARY KEY,
+	"SubscriptionId" INTEGER NOT NULL,
+	"VerifyToken" TEXT NOT NULL,
+	"UpdatedAt" TIMESTAMPTZ NOT NULL
+);
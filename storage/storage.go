@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	"go-strava-daemon/track"
+)
+
+// Retention policies applied to the contributions of a deauthorized user
+const (
+	PurgeDelete    = "delete"
+	PurgeAnonymize = "anonymize"
+)
+
+// Subscription : Strava webhook subscription shared by all instances of the daemon answering a callback URL
+type Subscription struct {
+	CallbackURL string
+	// ID : Subscription ID returned by Strava, 0 while there is none
+	ID          int
+	VerifyToken string
+	UpdatedAt   time.Time
+}
+
+// ContributionSink : Destination of the contributions created from Strava activities
+type ContributionSink interface {
+	// SaveActivityContributions : Replace the contributions created from a Strava activity, saving an activity again never duplicates it
+	// timeSource records how the timestamps of the points were obtained
+	SaveActivityContributions(contributions []dbmodel.Contribution, user *dbmodel.User, activityID int64, timeSource string) (replaced int, err error)
+	// DeleteActivity : Remove all contributions created from a Strava activity
+	DeleteActivity(activityID int64) (deleted int, err error)
+	// RejectActivity : Remove the contributions of a Strava activity and record why it was not turned into a contribution
+	RejectActivity(user *dbmodel.User, activityID int64, reason string) (deleted int, err error)
+}
+
+// Store : Storage of the users and contributions handled by the daemon
+type Store interface {
+	ContributionSink
+
+	// GetUserData : Get a user by their Strava athlete ID
+	GetUserData(providerUser string) (dbmodel.User, error)
+	// GetExpiringUsers : Get users whose access token expires within half an hour
+	GetExpiringUsers() ([]dbmodel.User, error)
+	// FetchNewUsers : Get users whose history has not been fetched yet
+	FetchNewUsers() ([]dbmodel.User, error)
+	// UpdateUser : Update the tokens and history state of a user
+	UpdateUser(user *dbmodel.User) error
+	// MarkHistoryFetched : Mark the history of a user as fetched without touching the tokens, purged users are skipped
+	MarkHistoryFetched(userID string) error
+	// PurgeUser : Wipe the tokens of a user and delete or anonymize their contributions
+	PurgeUser(user *dbmodel.User, policy string, reason string) (affected int, err error)
+	// GetBackfillCursor : Start (epoch) of the oldest activity handled by the history backfill, 0 when it has not started
+	GetBackfillCursor(userID string) (int64, error)
+	// SaveBackfillCursor : Persist the history backfill progress of a user
+	SaveBackfillCursor(userID string, before int64) error
+	// GetPrivacyZones : Get the zones declared by a user in which no points are stored
+	GetPrivacyZones(userID string) ([]track.Zone, error)
+	// GetSubscription : Get the subscription of a callback URL, empty when none was saved
+	GetSubscription(callbackURL string) (Subscription, error)
+	// SaveSubscription : Persist the subscription of its callback URL
+	SaveSubscription(subscription Subscription) error
+	// Ping : Check that the storage is reachable
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,325 @@
+package stravaclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/strava"
+
+	"go-strava-daemon/ratelimit"
+)
+
+// DefaultBaseURL : Base URL of the Strava API
+const DefaultBaseURL = "https://www.strava.com/api/v3"
+
+// DefaultTimeout : Timeout of a single request when none is configured
+const DefaultTimeout = 30 * time.Second
+
+// Client : Client for the Strava API endpoints used by the daemon
+type Client struct {
+	// BaseURL : Base URL of the API, DefaultBaseURL when empty
+	BaseURL string
+	// SubscriptionURL : URL of the push_subscriptions endpoint, derived from BaseURL when empty
+	SubscriptionURL string
+	ClientID        string
+	ClientSecret    string
+	// HTTPClient : Client performing the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Timeout : Timeout of a single request, waiting for the rate limiter is not included
+	Timeout time.Duration
+	// Limiter : Optional rate limiter shared with other clients
+	Limiter  *ratelimit.Limiter
+	Priority ratelimit.Priority
+	// Observe : Optional hook called after every request with the operation, the HTTP status (0 without response) and the duration
+	Observe func(operation string, status int, duration time.Duration)
+}
+
+// APIError : Error returned when Strava responds with an unexpected HTTP status
+type APIError struct {
+	StatusCode int          `json:"-"`
+	Method     string       `json:"-"`
+	Path       string       `json:"-"`
+	Message    string       `json:"message"`
+	Errors     []FieldError `json:"errors"`
+}
+
+// FieldError : Detail of an APIError
+type FieldError struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+}
+
+// Error : Describe the error
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("Strava responded with HTTP %v on %v %v", e.StatusCode, e.Method, e.Path)
+	if e.Message != "" {
+		msg = fmt.Sprintf("%v: %v", msg, e.Message)
+	}
+	for _, field := range e.Errors {
+		msg = fmt.Sprintf("%v (%v %v %v)", msg, field.Resource, field.Field, field.Code)
+	}
+	return msg
+}
+
+// statusOf : Get the HTTP status of an APIError, 0 for other errors
+func statusOf(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// IsRateLimited : Check if Strava refused the request because of the rate limit
+func IsRateLimited(err error) bool {
+	return statusOf(err) == http.StatusTooManyRequests
+}
+
+// IsNotFound : Check if the requested resource does not exist (anymore)
+func IsNotFound(err error) bool {
+	return statusOf(err) == http.StatusNotFound
+}
+
+// IsUnauthorized : Check if the access token was refused
+func IsUnauthorized(err error) bool {
+	status := statusOf(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// Activity : Struct representing an activity from Strava
+type Activity struct {
+	ID                 int64       `json:"id"`
+	Distance           float32     `json:"distance"`
+	MovingTime         int         `json:"moving_time"`
+	ElapsedTime        int         `json:"elapsed_time"`
+	TotalElevationGain float64     `json:"total_elevation_gain"`
+	Type               string      `json:"type"`
+	WorkoutType        int         `json:"workout_type"`
+	StartDate          time.Time   `json:"start_date"`
+	StartDateLocal     time.Time   `json:"start_date_local"`
+	StartLatlng        []float64   `json:"start_latlng"`
+	EndLatlng          []float64   `json:"end_latlng"`
+	Map                ActivityMap `json:"map"`
+	Commute            bool        `json:"commute"`
+	Trainer            bool        `json:"trainer"`
+	Manual             bool        `json:"manual"`
+}
+
+// ActivityMap : Struct representing the Map field in an activity message
+type ActivityMap struct {
+	ID              string `json:"id"`
+	Polyline        string `json:"polyline"`
+	ResourceState   int    `json:"resource_state"`
+	SummaryPolyline string `json:"summary_polyline"`
+}
+
+// StreamSet : Struct representing the streams of an activity, keyed by stream type
+type StreamSet struct {
+	LatLng   LatLngStream `json:"latlng"`
+	Time     NumberStream `json:"time"`
+	Distance NumberStream `json:"distance"`
+	Altitude NumberStream `json:"altitude"`
+}
+
+// LatLngStream : Struct representing a stream of [lat, lng] pairs
+type LatLngStream struct {
+	Data       [][]float64 `json:"data"`
+	SeriesType string      `json:"series_type"`
+	Resolution string      `json:"resolution"`
+}
+
+// NumberStream : Struct representing a stream of numeric values
+type NumberStream struct {
+	Data       []float64 `json:"data"`
+	SeriesType string    `json:"series_type"`
+	Resolution string    `json:"resolution"`
+}
+
+// Subscription : Struct representing a webhook push subscription
+type Subscription struct {
+	ID            int       `json:"id"`
+	ApplicationID int       `json:"application_id"`
+	CallbackURL   string    `json:"callback_url"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ListOptions : Paging and time window of an athlete activities request
+type ListOptions struct {
+	Page    int
+	PerPage int
+	// Before & After : Epoch timestamps limiting the start of the activities, ignored when 0
+	Before int64
+	After  int64
+}
+
+// baseURL : Get the configured base URL
+func (c *Client) baseURL() string {
+	if c.BaseURL == "" {
+		return DefaultBaseURL
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
+
+// subscriptionURL : Get the configured push_subscriptions URL
+func (c *Client) subscriptionURL() string {
+	if c.SubscriptionURL == "" {
+		return c.baseURL() + "/push_subscriptions"
+	}
+	return c.SubscriptionURL
+}
+
+// do : Perform a request for an operation and decode the JSON response into result
+func (c *Client) do(ctx context.Context, operation string, method string, endpoint string, accessToken string, form url.Values, result interface{}) error {
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx, c.Priority); err != nil {
+			return err
+		}
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("Could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", accessToken))
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	start := time.Now()
+	response, err := httpClient.Do(req)
+	if c.Observe != nil {
+		status := 0
+		if response != nil {
+			status = response.StatusCode
+		}
+		c.Observe(operation, status, time.Since(start))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not make request: %v", err)
+	}
+	defer response.Body.Close()
+	if c.Limiter != nil {
+		c.Limiter.Update(response)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		apiErr := &APIError{
+			StatusCode: response.StatusCode,
+			Method:     method,
+			Path:       req.URL.Path,
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("Could not decode response of %v %v: %v", method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// GetActivity : Fetch a single activity
+func (c *Client) GetActivity(ctx context.Context, accessToken string, id int64) (activity Activity, err error) {
+	err = c.do(ctx, "get_activity", "GET", fmt.Sprintf("%v/activities/%v", c.baseURL(), id), accessToken, nil, &activity)
+	return
+}
+
+// ListAthleteActivities : Fetch a page of activities of the authenticated athlete
+func (c *Client) ListAthleteActivities(ctx context.Context, accessToken string, opts ListOptions) (activities []Activity, err error) {
+	query := url.Values{}
+	if opts.Page > 0 {
+		query.Set("page", strconv.Itoa(opts.Page))
+	}
+	if opts.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(opts.PerPage))
+	}
+	if opts.Before > 0 {
+		query.Set("before", strconv.FormatInt(opts.Before, 10))
+	}
+	if opts.After > 0 {
+		query.Set("after", strconv.FormatInt(opts.After, 10))
+	}
+	err = c.do(ctx, "list_athlete_activities", "GET", fmt.Sprintf("%v/athlete/activities?%v", c.baseURL(), query.Encode()), accessToken, nil, &activities)
+	return
+}
+
+// GetActivityStreams : Fetch the streams of an activity, keyed by stream type
+func (c *Client) GetActivityStreams(ctx context.Context, accessToken string, id int64, keys ...string) (streams StreamSet, err error) {
+	query := url.Values{}
+	query.Set("keys", strings.Join(keys, ","))
+	query.Set("key_by_type", "true")
+	err = c.do(ctx, "get_activity_streams", "GET", fmt.Sprintf("%v/activities/%v/streams?%v", c.baseURL(), id, query.Encode()), accessToken, nil, &streams)
+	return
+}
+
+// RefreshToken : Exchange a refresh token for a new access token
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (msg strava.RefreshMessage, err error) {
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	err = c.do(ctx, "refresh_token", "POST", fmt.Sprintf("%v/oauth/token", c.baseURL()), "", form, &msg)
+	return
+}
+
+// ListSubscriptions : Fetch the webhook subscriptions of the application
+func (c *Client) ListSubscriptions(ctx context.Context) (subscriptions []Subscription, err error) {
+	query := url.Values{}
+	query.Set("client_id", c.ClientID)
+	query.Set("client_secret", c.ClientSecret)
+	err = c.do(ctx, "list_subscriptions", "GET", fmt.Sprintf("%v?%v", c.subscriptionURL(), query.Encode()), "", nil, &subscriptions)
+	return
+}
+
+// CreateSubscription : Create a webhook subscription, Strava validates the callback URL before responding
+func (c *Client) CreateSubscription(ctx context.Context, callbackURL string, verifyToken string) (subscription Subscription, err error) {
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+	form.Set("callback_url", callbackURL)
+	form.Set("verify_token", verifyToken)
+	err = c.do(ctx, "create_subscription", "POST", c.subscriptionURL(), "", form, &subscription)
+	return
+}
+
+// DeleteSubscription : Delete a webhook subscription
+func (c *Client) DeleteSubscription(ctx context.Context, id int) error {
+	query := url.Values{}
+	query.Set("client_id", c.ClientID)
+	query.Set("client_secret", c.ClientSecret)
+	return c.do(ctx, "delete_subscription", "DELETE", fmt.Sprintf("%v/%v?%v", c.subscriptionURL(), id, query.Encode()), "", nil, nil)
+}
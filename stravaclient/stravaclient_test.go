@@ -0,0 +1,126 @@
+package stravaclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListAthleteActivities(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/athlete/activities" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if query.Get("page") != "2" || query.Get("per_page") != "10" || query.Get("before") != "1595230200" || query.Get("after") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `[{"id": 1001, "type": "Ride", "start_date": "2020-07-20T07:30:00Z", "map": {"summary_polyline": "abc"}}]`)
+	}))
+	defer server.Close()
+
+	var observed []string
+	client := &Client{BaseURL: server.URL + "/", Observe: func(operation string, status int, duration time.Duration) {
+		observed = append(observed, fmt.Sprintf("%v %v", operation, status))
+	}}
+	activities, err := client.ListAthleteActivities(context.Background(), "token", ListOptions{Page: 2, PerPage: 10, Before: 1595230200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 1 || activities[0].ID != 1001 || activities[0].Type != "Ride" || activities[0].Map.SummaryPolyline != "abc" {
+		t.Errorf("activities %+v", activities)
+	}
+	if !activities[0].StartDate.Equal(time.Date(2020, 7, 20, 7, 30, 0, 0, time.UTC)) {
+		t.Errorf("start date %v", activities[0].StartDate)
+	}
+	if len(observed) != 1 || observed[0] != "list_athlete_activities 200" {
+		t.Errorf("observed %v", observed)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		status       int
+		rateLimited  bool
+		notFound     bool
+		unauthorized bool
+	}{
+		{http.StatusTooManyRequests, true, false, false},
+		{http.StatusNotFound, false, true, false},
+		{http.StatusUnauthorized, false, false, true},
+		{http.StatusForbidden, false, false, true},
+		{http.StatusInternalServerError, false, false, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, `{"message": "Refused", "errors": [{"resource": "Activity", "field": "id", "code": "invalid"}]}`)
+		}))
+		_, err := (&Client{BaseURL: server.URL}).GetActivity(context.Background(), "token", 1001)
+		server.Close()
+
+		// The checks look through wrapped errors
+		wrapped := fmt.Errorf("Could not fetch activity: %w", err)
+		if IsRateLimited(wrapped) != test.rateLimited || IsNotFound(wrapped) != test.notFound || IsUnauthorized(wrapped) != test.unauthorized {
+			t.Errorf("HTTP %v: rate limited %v, not found %v, unauthorized %v", test.status, IsRateLimited(wrapped), IsNotFound(wrapped), IsUnauthorized(wrapped))
+		}
+		if msg := fmt.Sprint(err); !strings.Contains(msg, fmt.Sprintf("HTTP %v on GET /activities/1001: Refused (Activity id invalid)", test.status)) {
+			t.Errorf("HTTP %v: error %q", test.status, msg)
+		}
+	}
+
+	// Errors without a response are not API errors
+	err := fmt.Errorf("Could not make request: %v", context.DeadlineExceeded)
+	if IsRateLimited(err) || IsNotFound(err) || IsUnauthorized(err) {
+		t.Errorf("%v taken for an API error", err)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != "POST" || r.URL.Path != "/oauth/token" || r.Header.Get("Authorization") != "" ||
+			r.Form.Get("client_id") != "id" || r.Form.Get("client_secret") != "secret" ||
+			r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"token_type": "Bearer", "access_token": "new-access", "refresh_token": "new-refresh", "expires_at": 1595251800, "expires_in": 21600}`)
+	}))
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL, ClientID: "id", ClientSecret: "secret"}
+	msg, err := client.RefreshToken(context.Background(), "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.AccessToken != "new-access" || msg.RefreshToken != "new-refresh" || msg.ExpiresAt != 1595251800 || msg.ExpiresIn != 21600 {
+		t.Errorf("refresh message %+v", msg)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var status = -1
+	client := &Client{BaseURL: server.URL, Timeout: 20 * time.Millisecond, Observe: func(operation string, s int, duration time.Duration) {
+		status = s
+	}}
+	if _, err := client.GetActivity(context.Background(), "token", 1001); err == nil {
+		t.Fatal("request outlived the timeout")
+	}
+	if status != 0 {
+		t.Errorf("observed status %v, want 0 without response", status)
+	}
+}
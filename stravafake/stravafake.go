@@ -0,0 +1,481 @@
+package stravafake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/strava"
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/stravaclient"
+)
+
+// Athlete : Fixture of a Strava athlete and their activities
+type Athlete struct {
+	ID           int        `json:"id"`
+	AccessToken  string     `json:"access_token"`
+	RefreshToken string     `json:"refresh_token"`
+	Activities   []Activity `json:"activities"`
+}
+
+// Activity : Fixture of a Strava activity, the streams are optional
+type Activity struct {
+	stravaclient.Activity
+	Streams *stravaclient.StreamSet `json:"streams,omitempty"`
+}
+
+// Fixtures : Athletes the fake server starts with
+type Fixtures struct {
+	Athletes []Athlete `json:"athletes"`
+}
+
+// Event : Webhook event sent to the subscription callback
+type Event struct {
+	ObjectType string            `json:"object_type"`
+	ObjectID   int64             `json:"object_id"`
+	AspectType string            `json:"aspect_type"`
+	OwnerID    int               `json:"owner_id"`
+	Updates    map[string]string `json:"updates"`
+}
+
+// LoadFixtures : Read fixtures from a JSON file
+func LoadFixtures(file string) (fixtures Fixtures, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &fixtures)
+	return
+}
+
+// Server : In-process fake of the Strava API endpoints used by the daemon
+type Server struct {
+	ClientID     string
+	ClientSecret string
+	// ShortLimit & DailyLimit : Rate limits reported in the X-RateLimit headers
+	ShortLimit int
+	DailyLimit int
+
+	mu             sync.Mutex
+	athletes       map[int]*Athlete
+	subscriptions  []stravaclient.Subscription
+	subscriptionID int
+	usage          int
+	rateLimitNext  int
+	client         *http.Client
+}
+
+// New : Create a fake server loaded with fixtures
+func New(clientID string, clientSecret string, fixtures Fixtures) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		ShortLimit:   600,
+		DailyLimit:   30000,
+		athletes:     map[int]*Athlete{},
+		client:       &http.Client{Timeout: 2 * time.Second},
+	}
+	for _, athlete := range fixtures.Athletes {
+		s.AddAthlete(athlete)
+	}
+	return s
+}
+
+// AddAthlete : Add or replace an athlete
+func (s *Server) AddAthlete(athlete Athlete) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := athlete
+	s.athletes[athlete.ID] = &a
+}
+
+// AddActivity : Add or replace an activity of an athlete
+func (s *Server) AddActivity(athleteID int, activity Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	athlete, ok := s.athletes[athleteID]
+	if !ok {
+		return fmt.Errorf("Unknown athlete %v", athleteID)
+	}
+	for i, existing := range athlete.Activities {
+		if existing.ID == activity.ID {
+			athlete.Activities[i] = activity
+			return nil
+		}
+	}
+	athlete.Activities = append(athlete.Activities, activity)
+	return nil
+}
+
+// DeleteActivity : Remove an activity of an athlete
+func (s *Server) DeleteActivity(athleteID int, id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	athlete, ok := s.athletes[athleteID]
+	if !ok {
+		return
+	}
+	for i, existing := range athlete.Activities {
+		if existing.ID == id {
+			athlete.Activities = append(athlete.Activities[:i], athlete.Activities[i+1:]...)
+			return
+		}
+	}
+}
+
+// RateLimitNext : Answer the next n requests with HTTP 429
+func (s *Server) RateLimitNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimitNext = n
+}
+
+// Subscriptions : Active webhook subscriptions
+func (s *Server) Subscriptions() []stravaclient.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stravaclient.Subscription{}, s.subscriptions...)
+}
+
+// SendEvent : Post a webhook event to the callback of the active subscription
+func (s *Server) SendEvent(event Event) error {
+	subscriptions := s.Subscriptions()
+	if len(subscriptions) == 0 {
+		return fmt.Errorf("There is no active subscription")
+	}
+	subscription := subscriptions[0]
+
+	body, err := json.Marshal(map[string]interface{}{
+		"object_type":     event.ObjectType,
+		"object_id":       event.ObjectID,
+		"aspect_type":     event.AspectType,
+		"owner_id":        event.OwnerID,
+		"subscription_id": subscription.ID,
+		"event_time":      time.Now().Unix(),
+		"updates":         event.Updates,
+	})
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(subscription.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Could not deliver event: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Callback responded with HTTP %v", response.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP : Route a request to the fake endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Scripting endpoints are not part of the Strava API and not rate limited
+	if strings.HasPrefix(r.URL.Path, "/_fake/") {
+		s.handleScript(w, r)
+		return
+	}
+
+	if s.countRequest(w) {
+		writeError(w, http.StatusTooManyRequests, "Rate Limit Exceeded")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "push_subscriptions":
+		s.handleSubscriptions(w, r, parts[1:])
+	case parts[0] == "oauth" && len(parts) == 2 && parts[1] == "token" && r.Method == "POST":
+		s.handleToken(w, r)
+	case parts[0] == "athlete" && len(parts) == 2 && parts[1] == "activities" && r.Method == "GET":
+		s.handleAthleteActivities(w, r)
+	case parts[0] == "activities" && (len(parts) == 2 || len(parts) == 3 && parts[2] == "streams") && r.Method == "GET":
+		s.handleActivity(w, r, parts[1], len(parts) == 3)
+	default:
+		writeError(w, http.StatusNotFound, "Record Not Found")
+	}
+}
+
+// countRequest : Count a request, set the rate limit headers and report whether it exceeds the limit
+func (s *Server) countRequest(w http.ResponseWriter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage++
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%v,%v", s.ShortLimit, s.DailyLimit))
+	w.Header().Set("X-RateLimit-Usage", fmt.Sprintf("%v,%v", s.usage, s.usage))
+	if s.rateLimitNext > 0 {
+		s.rateLimitNext--
+		return true
+	}
+	return s.usage > s.ShortLimit || s.usage > s.DailyLimit
+}
+
+// checkClient : Validate the application credentials of a request
+func (s *Server) checkClient(values url.Values) bool {
+	return values.Get("client_id") == s.ClientID && values.Get("client_secret") == s.ClientSecret
+}
+
+// athleteByToken : Find the athlete an access token belongs to
+func (s *Server) athleteByToken(r *http.Request) *Athlete {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, athlete := range s.athletes {
+		if token != "" && athlete.AccessToken == token {
+			return athlete
+		}
+	}
+	return nil
+}
+
+// handleSubscriptions : Fake of the push_subscriptions endpoints
+func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request, parts []string) {
+	r.ParseForm()
+	if !s.checkClient(r.Form) {
+		writeError(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && len(parts) == 0:
+		writeJSON(w, http.StatusOK, s.Subscriptions())
+	case r.Method == "POST" && len(parts) == 0:
+		if len(s.Subscriptions()) > 0 {
+			writeError(w, http.StatusBadRequest, "Bad Request: subscription already exists")
+			return
+		}
+		callbackURL := r.Form.Get("callback_url")
+		if err := s.verifyCallback(callbackURL, r.Form.Get("verify_token")); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad Request: callback url not verifiable: %v", err))
+			return
+		}
+
+		s.mu.Lock()
+		s.subscriptionID++
+		subscription := stravaclient.Subscription{
+			ID:          s.subscriptionID,
+			CallbackURL: callbackURL,
+			CreatedAt:   time.Now().UTC(),
+			UpdatedAt:   time.Now().UTC(),
+		}
+		s.subscriptions = append(s.subscriptions, subscription)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusCreated, map[string]int{"id": subscription.ID})
+	case r.Method == "DELETE" && len(parts) == 1:
+		id, _ := strconv.Atoi(parts[0])
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, subscription := range s.subscriptions {
+			if subscription.ID == id {
+				s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "Record Not Found")
+	default:
+		writeError(w, http.StatusNotFound, "Record Not Found")
+	}
+}
+
+// verifyCallback : Perform the hub.challenge handshake against a callback URL
+func (s *Server) verifyCallback(callbackURL string, verifyToken string) error {
+	challenge := strconv.FormatInt(time.Now().UnixNano(), 36)
+	query := url.Values{}
+	query.Set("hub.mode", "subscribe")
+	query.Set("hub.challenge", challenge)
+	query.Set("hub.verify_token", verifyToken)
+
+	separator := "?"
+	if strings.Contains(callbackURL, "?") {
+		separator = "&"
+	}
+	response, err := s.client.Get(callbackURL + separator + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var msg strava.WebhookValidationRequest
+	if err := json.NewDecoder(response.Body).Decode(&msg); err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK || msg.HubChallenge != challenge {
+		return fmt.Errorf("callback did not echo the challenge")
+	}
+	return nil
+}
+
+// handleToken : Fake of the OAuth token refresh
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if !s.checkClient(r.Form) || r.Form.Get("grant_type") != "refresh_token" {
+		writeError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, athlete := range s.athletes {
+		if athlete.RefreshToken != "" && athlete.RefreshToken == r.Form.Get("refresh_token") {
+			suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+			athlete.AccessToken = fmt.Sprintf("access-%v-%v", athlete.ID, suffix)
+			athlete.RefreshToken = fmt.Sprintf("refresh-%v-%v", athlete.ID, suffix)
+			writeJSON(w, http.StatusOK, strava.RefreshMessage{
+				TokenType:    "Bearer",
+				AccessToken:  athlete.AccessToken,
+				RefreshToken: athlete.RefreshToken,
+				ExpiresAt:    int(time.Now().Add(6 * time.Hour).Unix()),
+				ExpiresIn:    int((6 * time.Hour).Seconds()),
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusBadRequest, "Bad Request: invalid refresh_token")
+}
+
+// handleAthleteActivities : Fake of the paginated athlete activities
+func (s *Server) handleAthleteActivities(w http.ResponseWriter, r *http.Request) {
+	athlete := s.athleteByToken(r)
+	if athlete == nil {
+		writeError(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	if perPage < 1 {
+		perPage = 30
+	}
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+
+	s.mu.Lock()
+	var activities []stravaclient.Activity
+	for _, activity := range athlete.Activities {
+		start := activity.StartDate.Unix()
+		if (before > 0 && start >= before) || (after > 0 && start <= after) {
+			continue
+		}
+		activities = append(activities, activity.Activity)
+	}
+	s.mu.Unlock()
+
+	// Newest first, oldest first when paging forward with after
+	sort.Slice(activities, func(i, j int) bool {
+		if after > 0 {
+			return activities[i].StartDate.Before(activities[j].StartDate)
+		}
+		return activities[i].StartDate.After(activities[j].StartDate)
+	})
+
+	result := []stravaclient.Activity{}
+	if from := (page - 1) * perPage; from < len(activities) {
+		to := from + perPage
+		if to > len(activities) {
+			to = len(activities)
+		}
+		result = activities[from:to]
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleActivity : Fake of a single activity and its streams
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request, rawID string, streams bool) {
+	athlete := s.athleteByToken(r)
+	if athlete == nil {
+		writeError(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, activity := range athlete.Activities {
+		if activity.ID != id {
+			continue
+		}
+		if !streams {
+			writeJSON(w, http.StatusOK, activity.Activity)
+		} else if activity.Streams != nil {
+			writeJSON(w, http.StatusOK, activity.Streams)
+		} else {
+			writeError(w, http.StatusNotFound, "Record Not Found")
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "Record Not Found")
+}
+
+// handleScript : Endpoints to script the fake while it is running
+//
+//	POST /_fake/events        body: Event, delivered to the subscription callback
+//	POST /_fake/ratelimit?n=  answer the next n requests with HTTP 429
+//	POST /_fake/activities?athlete=  body: Activity, added to the athlete
+//	DELETE /_fake/activities?athlete=&id=
+func (s *Server) handleScript(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	athleteID, _ := strconv.Atoi(query.Get("athlete"))
+
+	switch {
+	case r.URL.Path == "/_fake/events" && r.Method == "POST":
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.SendEvent(event); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/_fake/ratelimit" && r.Method == "POST":
+		n, _ := strconv.Atoi(query.Get("n"))
+		s.RateLimitNext(n)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/_fake/activities" && r.Method == "POST":
+		var activity Activity
+		if err := json.NewDecoder(r.Body).Decode(&activity); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.AddActivity(athleteID, activity); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/_fake/activities" && r.Method == "DELETE":
+		id, _ := strconv.ParseInt(query.Get("id"), 10, 64)
+		s.DeleteActivity(athleteID, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "Unknown fake endpoint")
+	}
+}
+
+// writeJSON : Send a JSON response
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.Warnf("Fake Strava could not encode response: %v", err)
+	}
+}
+
+// writeError : Send an error in the format Strava uses
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, stravaclient.APIError{Message: message})
+}
@@ -0,0 +1,193 @@
+package stravafake
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/strava"
+
+	"go-strava-daemon/stravaclient"
+)
+
+// startTestServer : Serve the example fixtures, remove stops the server
+func startTestServer(t *testing.T) (s *Server, client *stravaclient.Client, remove func()) {
+	t.Helper()
+	fixtures, err := LoadFixtures("fixtures.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New("id", "secret", fixtures)
+	server := httptest.NewServer(s)
+	client = &stravaclient.Client{BaseURL: server.URL, ClientID: "id", ClientSecret: "secret"}
+	return s, client, server.Close
+}
+
+func TestRefreshToken(t *testing.T) {
+	_, client, remove := startTestServer(t)
+	defer remove()
+	ctx := context.Background()
+
+	msg, err := client.RefreshToken(ctx, "refresh-12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.AccessToken == "access-12345" || msg.RefreshToken == "refresh-12345" || msg.ExpiresAt <= int(time.Now().Unix()) {
+		t.Fatalf("refresh message %+v", msg)
+	}
+
+	// Only the new tokens are accepted
+	if _, err := client.ListAthleteActivities(ctx, msg.AccessToken, stravaclient.ListOptions{}); err != nil {
+		t.Errorf("new access token refused: %v", err)
+	}
+	if _, err := client.ListAthleteActivities(ctx, "access-12345", stravaclient.ListOptions{}); !stravaclient.IsUnauthorized(err) {
+		t.Errorf("old access token accepted (%v)", err)
+	}
+	if _, err := client.RefreshToken(ctx, "refresh-12345"); err == nil {
+		t.Error("old refresh token accepted")
+	}
+
+	// The application credentials are checked
+	client.ClientSecret = "wrong"
+	if _, err := client.RefreshToken(ctx, msg.RefreshToken); err == nil {
+		t.Error("refresh accepted with a wrong client secret")
+	}
+}
+
+func TestListAthleteActivities(t *testing.T) {
+	_, client, remove := startTestServer(t)
+	defer remove()
+	ctx := context.Background()
+	ride := time.Date(2020, 7, 20, 7, 30, 0, 0, time.UTC).Unix()
+	run := time.Date(2020, 7, 21, 18, 0, 0, 0, time.UTC).Unix()
+
+	tests := []struct {
+		name string
+		opts stravaclient.ListOptions
+		ids  []int64
+	}{
+		{"newest first", stravaclient.ListOptions{}, []int64{1002, 1001}},
+		{"paged", stravaclient.ListOptions{Page: 2, PerPage: 1}, []int64{1001}},
+		{"past the last page", stravaclient.ListOptions{Page: 3, PerPage: 1}, nil},
+		{"before is exclusive", stravaclient.ListOptions{Before: run}, []int64{1001}},
+		{"before includes earlier", stravaclient.ListOptions{Before: run + 1}, []int64{1002, 1001}},
+		{"after is exclusive and oldest first", stravaclient.ListOptions{After: ride}, []int64{1002}},
+		{"after oldest first", stravaclient.ListOptions{After: ride - 1}, []int64{1001, 1002}},
+	}
+	for _, test := range tests {
+		activities, err := client.ListAthleteActivities(ctx, "access-12345", test.opts)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		var ids []int64
+		for _, activity := range activities {
+			ids = append(ids, activity.ID)
+		}
+		if len(ids) != len(test.ids) {
+			t.Errorf("%v: activities %v, want %v", test.name, ids, test.ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.ids[i] {
+				t.Errorf("%v: activities %v, want %v", test.name, ids, test.ids)
+				break
+			}
+		}
+	}
+}
+
+func TestActivityStreams(t *testing.T) {
+	s, client, remove := startTestServer(t)
+	defer remove()
+	ctx := context.Background()
+
+	streams, err := client.GetActivityStreams(ctx, "access-12345", 1001, "latlng", "time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams.LatLng.Data) == 0 || len(streams.LatLng.Data) != len(streams.Time.Data) {
+		t.Errorf("streams of %v points and %v times", len(streams.LatLng.Data), len(streams.Time.Data))
+	}
+
+	// Activities without streams and deleted activities are not found
+	if _, err := client.GetActivityStreams(ctx, "access-12345", 1002, "latlng", "time"); !stravaclient.IsNotFound(err) {
+		t.Errorf("streams of an activity without streams (%v)", err)
+	}
+	s.DeleteActivity(12345, 1001)
+	if _, err := client.GetActivity(ctx, "access-12345", 1001); !stravaclient.IsNotFound(err) {
+		t.Errorf("deleted activity found (%v)", err)
+	}
+}
+
+func TestRateLimitNext(t *testing.T) {
+	s, client, remove := startTestServer(t)
+	defer remove()
+	ctx := context.Background()
+
+	s.RateLimitNext(2)
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetActivity(ctx, "access-12345", 1001); !stravaclient.IsRateLimited(err) {
+			t.Fatalf("request %v not rate limited (%v)", i, err)
+		}
+	}
+	if _, err := client.GetActivity(ctx, "access-12345", 1001); err != nil {
+		t.Errorf("request after the rate limit: %v", err)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s, client, remove := startTestServer(t)
+	defer remove()
+	ctx := context.Background()
+
+	// Callback echoing the challenge for the right verify token and recording the events
+	events := make(chan Event, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var event Event
+			data, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(data, &event)
+			events <- event
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("hub.verify_token") != "verify" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(strava.WebhookValidationRequest{HubChallenge: query.Get("hub.challenge")})
+	}))
+	defer callback.Close()
+
+	if _, err := client.CreateSubscription(ctx, callback.URL, "wrong"); err == nil {
+		t.Fatal("subscription created with a wrong verify token")
+	}
+	subscription, err := client.CreateSubscription(ctx, callback.URL, "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateSubscription(ctx, callback.URL, "verify"); err == nil {
+		t.Error("second subscription created")
+	}
+	if listed, err := client.ListSubscriptions(ctx); err != nil || len(listed) != 1 || listed[0].ID != subscription.ID || listed[0].CallbackURL != callback.URL {
+		t.Errorf("subscriptions %+v (%v)", listed, err)
+	}
+
+	if err := s.SendEvent(Event{ObjectType: "activity", ObjectID: 1001, AspectType: "create", OwnerID: 12345}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.ObjectID != 1001 || event.OwnerID != 12345 || event.AspectType != "create" {
+		t.Errorf("event %+v", event)
+	}
+
+	if err := client.DeleteSubscription(ctx, subscription.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendEvent(Event{ObjectType: "activity", ObjectID: 1001, AspectType: "delete", OwnerID: 12345}); err == nil {
+		t.Error("event sent without subscription")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/config"
+	"go-strava-daemon/storage"
+)
+
+// subscriptionRetry : First delay before retrying a failed reconciliation, doubled on every failure up to the check interval
+const subscriptionRetry = 10 * time.Second
+
+// storedSubscriptionTTL : Time the stored subscription is used to check webhook requests before it is read again
+const storedSubscriptionTTL = 30 * time.Second
+
+// Stored subscription, webhook requests are unauthenticated and only checked against this copy
+var (
+	storedMu           sync.Mutex
+	storedSubscription storage.Subscription
+	storedRead         time.Time
+)
+
+// cacheSubscription : Remember the stored subscription
+func cacheSubscription(subscription storage.Subscription) {
+	storedMu.Lock()
+	defer storedMu.Unlock()
+	storedSubscription = subscription
+	storedRead = time.Now()
+}
+
+// cachedSubscription : Get the stored subscription, read from the storage at most once per storedSubscriptionTTL
+func cachedSubscription() storage.Subscription {
+	storedMu.Lock()
+	defer storedMu.Unlock()
+	if time.Since(storedRead) > storedSubscriptionTTL {
+		// A failed read is not retried before the TTL passed either
+		if stored, err := db.GetSubscription(out.CallbackURL); err != nil {
+			log.Warnf("Could not get the stored subscription: %v", err)
+		} else {
+			storedSubscription = stored
+		}
+		storedRead = time.Now()
+	}
+	return storedSubscription
+}
+
+// restoreSubscription : Take the verify token and subscription ID shared through the storage, the verify token is saved when there is none yet
+func restoreSubscription(conf *config.Config) error {
+	stored, err := db.GetSubscription(out.CallbackURL)
+	if err != nil {
+		return fmt.Errorf("Could not get the stored subscription: %v", err)
+	}
+	if conf.StravaVerifyToken == "" && stored.VerifyToken != "" {
+		out.VerifyToken = stored.VerifyToken
+	}
+	if stored.ID != 0 {
+		log.Infof("Restored Strava subscription %v from storage", stored.ID)
+		out.SetSubscriptionID(stored.ID)
+	}
+	if stored.VerifyToken != out.VerifyToken {
+		stored.CallbackURL = out.CallbackURL
+		stored.VerifyToken = out.VerifyToken
+		if err := db.SaveSubscription(stored); err != nil {
+			return fmt.Errorf("Could not save the subscription: %v", err)
+		}
+	}
+	cacheSubscription(stored)
+	return nil
+}
+
+// saveSubscription : Share the active subscription through the storage
+func saveSubscription() error {
+	subscription := storage.Subscription{
+		CallbackURL: out.CallbackURL,
+		ID:          out.SubscriptionID(),
+		VerifyToken: out.VerifyToken,
+	}
+	if err := db.SaveSubscription(subscription); err != nil {
+		return err
+	}
+	cacheSubscription(subscription)
+	return nil
+}
+
+// knownSubscription : Check the subscription ID of an event, an ID saved by another instance which replaced the subscription is taken over
+func knownSubscription(id int) bool {
+	if id == 0 {
+		return false
+	} else if id == out.SubscriptionID() {
+		return true
+	} else if cachedSubscription().ID != id {
+		return false
+	}
+	log.Infof("Using Strava subscription %v saved by another instance", id)
+	out.SetSubscriptionID(id)
+	return true
+}
+
+// knownVerifyToken : Check the verify token of a validation request, another instance may have saved the token it subscribed with
+func knownVerifyToken(token string) bool {
+	if token == "" {
+		return false
+	} else if token == out.VerifyToken {
+		return true
+	}
+	return token == cachedSubscription().VerifyToken
+}
+
+// HandleSubscription : Reconcile the Strava subscription on start and every interval until ctx is cancelled, failures are retried with a backoff
+func HandleSubscription(ctx context.Context, interval time.Duration) {
+	delay := subscriptionRetry
+	saved := 0
+	for {
+		loopStarted("subscription")
+		next := interval
+		err := out.Reconcile(ctx)
+		if err == nil && out.SubscriptionID() != saved {
+			if err = saveSubscription(); err == nil {
+				saved = out.SubscriptionID()
+			} else {
+				err = fmt.Errorf("Could not save the subscription: %v", err)
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			next = delay
+			log.Warnf("Could not reconcile Strava subscription, retrying in %v: %v", next, err)
+			if delay *= 2; delay > interval {
+				delay = interval
+			}
+		} else {
+			delay = subscriptionRetry
+		}
+		loopFinished("subscription", next)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
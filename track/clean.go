@@ -0,0 +1,192 @@
+package track
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Stage : Step of a Pipeline, returns the track without the removed points
+type Stage interface {
+	Name() string
+	Apply(t Track) Track
+}
+
+// StageResult : Number of points removed by a stage
+type StageResult struct {
+	Stage   string
+	Removed int
+}
+
+// Results : Outcome of all stages of a pipeline run
+type Results []StageResult
+
+// String : Describe the removed points per stage
+func (r Results) String() string {
+	parts := make([]string, 0, len(r))
+	for _, result := range r {
+		parts = append(parts, fmt.Sprintf("%v=%v", result.Stage, result.Removed))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Pipeline : Stages applied to a track in order
+type Pipeline struct {
+	Stages []Stage
+}
+
+// Apply : Run all stages, stopping when no points are left
+func (p Pipeline) Apply(t Track) (Track, Results) {
+	results := make(Results, 0, len(p.Stages))
+	for _, stage := range p.Stages {
+		if t.Len() == 0 {
+			break
+		}
+		before := t.Len()
+		t = stage.Apply(t)
+		results = append(results, StageResult{Stage: stage.Name(), Removed: before - t.Len()})
+	}
+	return t, results
+}
+
+// speed : Speed in km/h between two points of a track, 0 when no time passed
+func speed(t Track, from int, to int) float64 {
+	seconds := t.Times[to].Sub(t.Times[from]).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return t.Point(from).GeoDistanceFrom(t.Point(to)) / seconds * 3.6
+}
+
+// MaxSpeed : Remove spikes, points that are reached and left faster than the limit
+type MaxSpeed struct {
+	// Limit : Speed limit in km/h
+	Limit float64
+}
+
+// Name : Name of the stage
+func (s MaxSpeed) Name() string {
+	return "max_speed"
+}
+
+// Apply : Remove the outliers
+func (s MaxSpeed) Apply(t Track) Track {
+	last := t.Len() - 1
+	previous := -1
+	kept := make([]bool, t.Len())
+	for i := range kept {
+		// Without a kept predecessor the point is compared with the point after its successor, a spike right after it must not remove it too
+		var spikeIn bool
+		if previous < 0 {
+			spikeIn = i+2 <= last && speed(t, i, i+2) > s.Limit
+		} else {
+			spikeIn = speed(t, previous, i) > s.Limit
+		}
+		// The last point only has one neighbour to compare with
+		spikeOut := i == last || speed(t, i, i+1) > s.Limit
+		if spikeIn && spikeOut && last > 0 {
+			continue
+		}
+		kept[i] = true
+		previous = i
+	}
+	return t.Filter(func(i int) bool { return kept[i] })
+}
+
+// Duplicates : Remove points that did not move away from the previous point
+type Duplicates struct {
+	// Distance : Points closer than this distance in meters to the previous point are removed, only identical points when 0
+	Distance float64
+}
+
+// Name : Name of the stage
+func (s Duplicates) Name() string {
+	return "duplicates"
+}
+
+// Apply : Remove the duplicates
+func (s Duplicates) Apply(t Track) Track {
+	previous := 0
+	return t.Filter(func(i int) bool {
+		if i == 0 {
+			return true
+		}
+		distance := t.Point(previous).GeoDistanceFrom(t.Point(i))
+		if distance < s.Distance || t.Point(previous).Equals(t.Point(i)) {
+			return false
+		}
+		previous = i
+		return true
+	})
+}
+
+// Stops : Collapse the points where the rider stood still into the first point of the stop
+type Stops struct {
+	// Radius : Points within this distance in meters of the first point of the stop belong to it
+	Radius float64
+	// Duration : Minimum time spent within the radius to count as a stop
+	Duration time.Duration
+}
+
+// Name : Name of the stage
+func (s Stops) Name() string {
+	return "stops"
+}
+
+// Apply : Remove all but the first point of every stop
+func (s Stops) Apply(t Track) Track {
+	removed := make([]bool, t.Len())
+	for anchor := 0; anchor < t.Len(); {
+		end := anchor + 1
+		for end < t.Len() && t.Point(anchor).GeoDistanceFrom(t.Point(end)) <= s.Radius {
+			end++
+		}
+		if end-1 > anchor && t.Times[end-1].Sub(t.Times[anchor]) >= s.Duration {
+			for i := anchor + 1; i < end; i++ {
+				removed[i] = true
+			}
+			anchor = end
+			continue
+		}
+		anchor++
+	}
+	return t.Filter(func(i int) bool { return !removed[i] })
+}
+
+// MinLength : Remove the whole track when it is too short
+type MinLength struct {
+	// Distance : Minimum length in meters
+	Distance float64
+	// Points : Minimum number of points
+	Points int
+}
+
+// Name : Name of the stage
+func (s MinLength) Name() string {
+	return "min_length"
+}
+
+// Apply : Empty the track when it is too short
+func (s MinLength) Apply(t Track) Track {
+	if t.Len() < s.Points || t.Distance() < s.Distance {
+		return t.Slice(0, 0)
+	}
+	return t
+}
+
+// Add : Add the removed points of other results per stage
+func (r Results) Add(other Results) Results {
+	for _, result := range other {
+		found := false
+		for i := range r {
+			if r[i].Stage == result.Stage {
+				r[i].Removed += result.Removed
+				found = true
+			}
+		}
+		if !found {
+			r = append(r, result)
+		}
+	}
+	return r
+}
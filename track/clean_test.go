@@ -0,0 +1,117 @@
+package track
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxSpeed(t *testing.T) {
+	// 0.0005° of latitude every 10 seconds is about 20 km/h, 0.05° is about 2000 km/h
+	tests := []struct {
+		name   string
+		points []float64
+		want   []float64
+	}{
+		{"no spikes", []float64{51.0000, 51.0005, 51.0010, 51.0015}, []float64{51.0000, 51.0005, 51.0010, 51.0015}},
+		{"spike in the middle", []float64{51.0000, 51.0005, 51.0500, 51.0010, 51.0015}, []float64{51.0000, 51.0005, 51.0010, 51.0015}},
+		{"spike after the first point", []float64{51.0000, 51.0500, 51.0005, 51.0010}, []float64{51.0000, 51.0005, 51.0010}},
+		{"spike as first point", []float64{51.0500, 51.0000, 51.0005, 51.0010}, []float64{51.0000, 51.0005, 51.0010}},
+		{"spike as last point", []float64{51.0000, 51.0005, 51.0010, 51.0500}, []float64{51.0000, 51.0005, 51.0010}},
+		{"spike as second of two points", []float64{51.0000, 51.0500}, []float64{51.0000}},
+		{"single point", []float64{51.0000}, []float64{51.0000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := latitudes(MaxSpeed{Limit: 100}.Apply(testTrack(t, test.points...)))
+			if !equalLatitudes(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	tests := []struct {
+		name     string
+		distance float64
+		points   []float64
+		want     []float64
+	}{
+		{"identical points", 0, []float64{51.0000, 51.0000, 51.0005, 51.0005}, []float64{51.0000, 51.0005}},
+		// 0.00005° of latitude is about 5.5 meters
+		{"within the distance", 10, []float64{51.0000, 51.00005, 51.0001, 51.0005}, []float64{51.0000, 51.0001, 51.0005}},
+		{"compared with the last kept point", 10, []float64{51.0000, 51.00005, 51.00008, 51.00012}, []float64{51.0000, 51.00012}},
+		{"no duplicates", 10, []float64{51.0000, 51.0005, 51.0010}, []float64{51.0000, 51.0005, 51.0010}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := latitudes(Duplicates{Distance: test.distance}.Apply(testTrack(t, test.points...)))
+			if !equalLatitudes(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStops(t *testing.T) {
+	stops := Stops{Radius: 20, Duration: time.Minute}
+	tests := []struct {
+		name   string
+		points []float64
+		want   []float64
+	}{
+		// 7 points 10 seconds apart within 20 meters: a stop of a minute
+		{"stop", []float64{51.0000, 51.0005, 51.0006, 51.0005, 51.0006, 51.0005, 51.0006, 51.0005, 51.0010}, []float64{51.0000, 51.0005, 51.0010}},
+		{"too short", []float64{51.0000, 51.0005, 51.0006, 51.0005, 51.0010}, []float64{51.0000, 51.0005, 51.0006, 51.0005, 51.0010}},
+		{"moving", []float64{51.0000, 51.0005, 51.0010, 51.0015}, []float64{51.0000, 51.0005, 51.0010, 51.0015}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := latitudes(stops.Apply(testTrack(t, test.points...)))
+			if !equalLatitudes(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinLength(t *testing.T) {
+	// 0.001° of latitude is about 111 meters
+	track := testTrack(t, 51.0000, 51.0005, 51.0010)
+	tests := []struct {
+		stage MinLength
+		kept  bool
+	}{
+		{MinLength{Distance: 100, Points: 2}, true},
+		{MinLength{Distance: 200, Points: 2}, false},
+		{MinLength{Points: 3}, true},
+		{MinLength{Points: 4}, false},
+	}
+	for _, test := range tests {
+		if got := test.stage.Apply(track).Len() > 0; got != test.kept {
+			t.Errorf("%+v: kept %v, want %v", test.stage, got, test.kept)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	pipeline := Pipeline{Stages: []Stage{
+		MaxSpeed{Limit: 100},
+		Duplicates{},
+		MinLength{Distance: 1000, Points: 2},
+		// Not run on an empty track
+		Duplicates{Distance: 1},
+	}}
+	cleaned, results := pipeline.Apply(testTrack(t, 51.0000, 51.0005, 51.0500, 51.0005, 51.0010))
+	if cleaned.Len() != 0 {
+		t.Errorf("%v points left, want none", cleaned.Len())
+	}
+	if got, want := results.String(), "max_speed=1 duplicates=1 min_length=3"; got != want {
+		t.Errorf("results %q, want %q", got, want)
+	}
+
+	total := results.Add(Results{{Stage: "duplicates", Removed: 2}, {Stage: "privacy", Removed: 4}})
+	if got, want := total.String(), "max_speed=1 duplicates=3 min_length=3 privacy=4"; got != want {
+		t.Errorf("added results %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package track
+
+import (
+	geo "github.com/paulmach/go.geo"
+)
+
+// Zone : Circular area in which no points are stored
+type Zone struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Radius : Radius in meters
+	Radius float64 `json:"radius"`
+}
+
+// Contains : Check if a point lies within the zone
+func (z Zone) Contains(point *geo.Point) bool {
+	// geo.Point is stored as [lng, lat]
+	center := geo.NewPoint(z.Longitude, z.Latitude)
+	return center.GeoDistanceFrom(point) <= z.Radius
+}
+
+// Privacy : Filter hiding the start, end and user-declared zones of a track
+type Privacy struct {
+	// Radius : Radius in meters cut around the start and end point, disabled when 0
+	Radius float64
+	Zones  []Zone
+}
+
+// Name : Name of the privacy filter in the results
+func (p Privacy) Name() string {
+	return "privacy"
+}
+
+// WithZones : Copy of the filter with additional zones
+func (p Privacy) WithZones(zones []Zone) Privacy {
+	p.Zones = append(append([]Zone{}, p.Zones...), zones...)
+	return p
+}
+
+// hides : Check if a point lies within one of the zones
+func (p Privacy) hides(point *geo.Point) bool {
+	for _, zone := range p.Zones {
+		if zone.Contains(point) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split : Remove the points near the start and end, and all points inside the zones
+// The track is split where it enters a zone, so no part connects the points on both sides of it
+func (p Privacy) Split(t Track) (parts []Track) {
+	if t.Len() == 0 {
+		return
+	}
+
+	// Cut the leading and trailing points until the track leaves the radius around its original start and end
+	from, to := 0, t.Len()
+	if p.Radius > 0 {
+		start := Zone{Latitude: t.Point(0).Lat(), Longitude: t.Point(0).Lng(), Radius: p.Radius}
+		end := Zone{Latitude: t.Point(t.Len() - 1).Lat(), Longitude: t.Point(t.Len() - 1).Lng(), Radius: p.Radius}
+		for from < to && start.Contains(t.Point(from)) {
+			from++
+		}
+		for to > from && end.Contains(t.Point(to-1)) {
+			to--
+		}
+	}
+
+	// Start of the part being collected, -1 while the track is inside a zone
+	first := -1
+	for i := from; i < to; i++ {
+		if !p.hides(t.Point(i)) {
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		if first >= 0 {
+			parts = append(parts, t.Slice(first, i))
+			first = -1
+		}
+	}
+	if first >= 0 {
+		parts = append(parts, t.Slice(first, to))
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package track
+
+import (
+	"testing"
+)
+
+func TestPrivacy(t *testing.T) {
+	// 0.0005° of latitude is about 55 meters
+	points := []float64{51.0000, 51.0005, 51.0010, 51.0015, 51.0020, 51.0025, 51.0030}
+	zone := Zone{Latitude: 51.0015, Longitude: 3.7174, Radius: 30}
+	tests := []struct {
+		name    string
+		privacy Privacy
+		want    [][]float64
+	}{
+		{"disabled", Privacy{}, [][]float64{points}},
+		{"radius", Privacy{Radius: 100}, [][]float64{{51.0010, 51.0015, 51.0020}}},
+		{"radius covering the track", Privacy{Radius: 1000}, nil},
+		{"zone", Privacy{Zones: []Zone{zone}}, [][]float64{{51.0000, 51.0005, 51.0010}, {51.0020, 51.0025, 51.0030}}},
+		{"radius and zone", Privacy{Radius: 100, Zones: []Zone{zone}}, [][]float64{{51.0010}, {51.0020}}},
+		{"zone at the start", Privacy{Zones: []Zone{{Latitude: 51.0000, Longitude: 3.7174, Radius: 30}}}, [][]float64{points[1:]}},
+		{"two zones", Privacy{Zones: []Zone{zone, {Latitude: 51.0025, Longitude: 3.7174, Radius: 30}}}, [][]float64{{51.0000, 51.0005, 51.0010}, {51.0020}, {51.0030}}},
+		{"zone elsewhere", Privacy{Zones: []Zone{{Latitude: 50.8503, Longitude: 4.3517, Radius: 500}}}, [][]float64{points}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts := test.privacy.Split(testTrack(t, points...))
+			if len(parts) != len(test.want) {
+				t.Fatalf("got %v parts, want %v", len(parts), len(test.want))
+			}
+			for i, part := range parts {
+				if got := latitudes(part); !equalLatitudes(got, test.want[i]) {
+					t.Errorf("part %v: got %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestZoneContains(t *testing.T) {
+	zone := Zone{Latitude: 51.0000, Longitude: 3.7174, Radius: 100}
+	track := testTrack(t, 51.0000, 51.0008, 51.0010)
+	for i, want := range []bool{true, true, false} {
+		if got := zone.Contains(track.Point(i)); got != want {
+			t.Errorf("point %v: contained %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestWithZones(t *testing.T) {
+	privacy := Privacy{Radius: 100, Zones: make([]Zone, 1, 2)}
+	extended := privacy.WithZones([]Zone{{Latitude: 51, Longitude: 3.7174, Radius: 50}})
+	if len(extended.Zones) != 2 || extended.Radius != 100 {
+		t.Errorf("extended filter %+v, want the radius and two zones", extended)
+	}
+	// The spare capacity of the original zones is not shared
+	other := privacy.WithZones([]Zone{{Latitude: 52, Longitude: 4, Radius: 50}})
+	if extended.Zones[1].Latitude != 51 || other.Zones[1].Latitude != 52 || len(privacy.Zones) != 1 {
+		t.Error("adding zones changed another filter")
+	}
+}
@@ -0,0 +1,80 @@
+package track
+
+import (
+	"fmt"
+
+	geo "github.com/paulmach/go.geo"
+	"github.com/paulmach/go.geo/reducers"
+)
+
+// Simplification methods
+const (
+	DouglasPeucker = "douglas-peucker"
+	Visvalingam    = "visvalingam"
+)
+
+// Simplify : Reduce the number of points, the remaining points keep their timestamps
+type Simplify struct {
+	Method string
+	// Tolerance : Maximum deviation in meters for Douglas-Peucker, Visvalingam removes triangles smaller than its square
+	Tolerance float64
+}
+
+// NewSimplify : Create a simplification stage, checking the method
+func NewSimplify(method string, tolerance float64) (Simplify, error) {
+	if method != DouglasPeucker && method != Visvalingam {
+		return Simplify{}, fmt.Errorf("Unknown simplification method %v, use %v or %v", method, DouglasPeucker, Visvalingam)
+	}
+	if tolerance <= 0 {
+		return Simplify{}, fmt.Errorf("The simplification tolerance must be positive")
+	}
+	return Simplify{Method: method, Tolerance: tolerance}, nil
+}
+
+// Name : Name of the stage
+func (s Simplify) Name() string {
+	return "simplify"
+}
+
+// Apply : Keep the points selected by the simplification method
+func (s Simplify) Apply(t Track) Track {
+	var indexMap []int
+	switch s.Method {
+	case DouglasPeucker:
+		_, indexMap = reducers.DouglasPeuckerGeoIndexMap(t.Path, s.Tolerance)
+	case Visvalingam:
+		indexMap = visvalingamIndexMap(t.Path, s.Tolerance*s.Tolerance)
+	default:
+		return t
+	}
+
+	// The original points are kept, the reducers return them after a projection round trip
+	kept := make([]bool, t.Len())
+	for _, i := range indexMap {
+		kept[i] = true
+	}
+	return t.Filter(func(i int) bool { return kept[i] })
+}
+
+// visvalingamIndexMap : Indexes of the points kept by Visvalingam-Whyatt with a threshold area in square meters
+func visvalingamIndexMap(path *geo.Path, area float64) []int {
+	if path.Length() == 0 {
+		return nil
+	}
+
+	// Run on a projected copy, the reducer does not report which points it kept
+	factor := geo.MercatorScaleFactor(path.Bound().Center().Lat())
+	projected := path.Clone().Transform(geo.Mercator.Project)
+	reduced := reducers.Visvalingam(projected, area*factor*factor, 2)
+
+	// The reduced points are a subsequence of the projected points
+	indexMap := make([]int, 0, reduced.Length())
+	next := 0
+	for i, point := range projected.Points() {
+		if next < reduced.Length() && point.Equals(reduced.GetAt(next)) {
+			indexMap = append(indexMap, i)
+			next++
+		}
+	}
+	return indexMap
+}
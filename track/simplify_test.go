@@ -0,0 +1,71 @@
+package track
+
+import (
+	"testing"
+)
+
+func TestNewSimplify(t *testing.T) {
+	tests := []struct {
+		method    string
+		tolerance float64
+		valid     bool
+	}{
+		{DouglasPeucker, 10, true},
+		{Visvalingam, 0.5, true},
+		{"radial", 10, false},
+		{"", 10, false},
+		{DouglasPeucker, 0, false},
+		{Visvalingam, -1, false},
+	}
+	for _, test := range tests {
+		if _, err := NewSimplify(test.method, test.tolerance); (err == nil) != test.valid {
+			t.Errorf("NewSimplify(%q, %v): error %v, want valid=%v", test.method, test.tolerance, err, test.valid)
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	// 0.001° of longitude is about 70 meters at this latitude
+	straight := []testPoint{{51.0000, 3.7174, 0}, {51.0005, 3.7174, 10}, {51.0010, 3.7174, 20}, {51.0015, 3.7174, 30}, {51.0020, 3.7174, 40}}
+	// The detour goes straight out and back, only its far point is needed
+	detour := []testPoint{{51.0000, 3.7174, 0}, {51.0005, 3.7179, 10}, {51.0010, 3.7184, 20}, {51.0015, 3.7179, 30}, {51.0020, 3.7174, 40}}
+	tests := []struct {
+		name   string
+		method string
+		points []testPoint
+		kept   []int
+	}{
+		{"douglas-peucker straight", DouglasPeucker, straight, []int{0, 4}},
+		{"douglas-peucker detour", DouglasPeucker, detour, []int{0, 2, 4}},
+		{"visvalingam straight", Visvalingam, straight, []int{0, 4}},
+		{"visvalingam detour", Visvalingam, detour, []int{0, 2, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			track := newTestTrack(t, test.points...)
+			stage, err := NewSimplify(test.method, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			simplified := stage.Apply(track)
+			if simplified.Len() != len(test.kept) {
+				t.Fatalf("%v points kept, want %v", simplified.Len(), len(test.kept))
+			}
+			// The kept points are the original points with their timestamps
+			for i, index := range test.kept {
+				if !simplified.Point(i).Equals(track.Point(index)) || !simplified.Times[i].Equal(track.Times[index]) {
+					t.Errorf("point %v is not original point %v", i, index)
+				}
+			}
+		})
+	}
+}
+
+func TestSimplifyEmpty(t *testing.T) {
+	empty := testTrack(t)
+	for _, method := range []string{DouglasPeucker, Visvalingam} {
+		if got := (Simplify{Method: method, Tolerance: 10}).Apply(empty); got.Len() != 0 {
+			t.Errorf("%v: %v points from an empty track", method, got.Len())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package track
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	geo "github.com/paulmach/go.geo"
+)
+
+// ErrTooShort : Returned when too little of a track is left to store
+var ErrTooShort = errors.New("track too short")
+
+// Track : Path of an activity with a timestamp per point
+type Track struct {
+	Path  *geo.Path
+	Times []time.Time
+}
+
+// New : Create a track, the path and timestamps must have the same length
+func New(path *geo.Path, times []time.Time) (Track, error) {
+	if path.Length() != len(times) {
+		return Track{}, fmt.Errorf("The path (%v points) and timestamps (%v) differ in length", path.Length(), len(times))
+	}
+	return Track{Path: path, Times: times}, nil
+}
+
+// Len : Number of points
+func (t Track) Len() int {
+	return len(t.Times)
+}
+
+// Start : Timestamp of the first point
+func (t Track) Start() time.Time {
+	return t.Times[0]
+}
+
+// Stop : Timestamp of the last point
+func (t Track) Stop() time.Time {
+	return t.Times[len(t.Times)-1]
+}
+
+// Duration : Time between the first and last point
+func (t Track) Duration() time.Duration {
+	if t.Len() == 0 {
+		return 0
+	}
+	return t.Stop().Sub(t.Start())
+}
+
+// Distance : Length of the track in meters
+func (t Track) Distance() float64 {
+	return t.Path.GeoDistance()
+}
+
+// Point : Point at index i
+func (t Track) Point(i int) *geo.Point {
+	return t.Path.GetAt(i)
+}
+
+// Slice : Points [from, to) of the track, sharing no memory with the original
+func (t Track) Slice(from int, to int) Track {
+	points := append([]geo.Point{}, t.Path.Points()[from:to]...)
+	times := append([]time.Time{}, t.Times[from:to]...)
+	return Track{Path: geo.NewPath().SetPoints(points), Times: times}
+}
+
+// Filter : Keep the points for which keep returns true
+func (t Track) Filter(keep func(i int) bool) Track {
+	points := make([]geo.Point, 0, t.Len())
+	times := make([]time.Time, 0, t.Len())
+	for i := 0; i < t.Len(); i++ {
+		if keep(i) {
+			points = append(points, *t.Point(i))
+			times = append(times, t.Times[i])
+		}
+	}
+	return Track{Path: geo.NewPath().SetPoints(points), Times: times}
+}
+
+// Split : Split the track where no point was recorded for longer than maxPause, the track is returned as is when maxPause is 0
+func (t Track) Split(maxPause time.Duration) (parts []Track) {
+	if maxPause <= 0 || t.Len() == 0 {
+		return []Track{t}
+	}
+	from := 0
+	for i := 1; i < t.Len(); i++ {
+		if t.Times[i].Sub(t.Times[i-1]) > maxPause {
+			parts = append(parts, t.Slice(from, i))
+			from = i
+		}
+	}
+	return append(parts, t.Slice(from, t.Len()))
+}
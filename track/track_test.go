@@ -0,0 +1,129 @@
+package track
+
+import (
+	"testing"
+	"time"
+
+	geo "github.com/paulmach/go.geo"
+)
+
+// testStart : Timestamp of the first point of the test tracks
+var testStart = time.Date(2020, 7, 20, 7, 30, 0, 0, time.UTC)
+
+// testPoint : Point of a test track, recorded seconds after testStart
+type testPoint struct {
+	lat     float64
+	lng     float64
+	seconds int
+}
+
+// newTestTrack : Create a track from test points
+func newTestTrack(t *testing.T, points ...testPoint) Track {
+	t.Helper()
+	path := geo.NewPath()
+	times := make([]time.Time, 0, len(points))
+	for _, point := range points {
+		path.Push(geo.NewPoint(point.lng, point.lat))
+		times = append(times, testStart.Add(time.Duration(point.seconds)*time.Second))
+	}
+	track, err := New(path, times)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+// testTrack : Track through the given latitudes along one meridian, one point every 10 seconds
+func testTrack(t *testing.T, latitudes ...float64) Track {
+	t.Helper()
+	points := make([]testPoint, 0, len(latitudes))
+	for i, latitude := range latitudes {
+		points = append(points, testPoint{lat: latitude, lng: 3.7174, seconds: 10 * i})
+	}
+	return newTestTrack(t, points...)
+}
+
+// latitudes : Latitudes of the points of a track
+func latitudes(track Track) []float64 {
+	result := make([]float64, 0, track.Len())
+	for i := 0; i < track.Len(); i++ {
+		result = append(result, track.Point(i).Lat())
+	}
+	return result
+}
+
+// equalLatitudes : Compare the latitudes of two tracks
+func equalLatitudes(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNew(t *testing.T) {
+	path := geo.NewPath()
+	path.Push(geo.NewPoint(3.7174, 51.0000))
+	if _, err := New(path, nil); err == nil {
+		t.Error("created a track without timestamps")
+	}
+
+	track := testTrack(t, 51.0000, 51.0010)
+	if track.Duration() != 10*time.Second || !track.Start().Equal(testStart) {
+		t.Errorf("track starts at %v and lasts %v", track.Start(), track.Duration())
+	}
+	// 0.001° of latitude is about 111 meters
+	if distance := track.Distance(); distance < 110 || distance > 112 {
+		t.Errorf("distance %v, want about 111 meters", distance)
+	}
+	if empty := track.Slice(0, 0); empty.Duration() != 0 {
+		t.Errorf("empty track lasts %v", empty.Duration())
+	}
+}
+
+func TestSlice(t *testing.T) {
+	track := testTrack(t, 51.0000, 51.0005, 51.0010)
+	slice := track.Slice(1, 3)
+	slice.Path.SetAt(0, geo.NewPoint(0, 0))
+	slice.Times[0] = time.Time{}
+	if track.Point(1).Lat() != 51.0005 || track.Times[1].IsZero() {
+		t.Error("changing a slice changed the original track")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  []int
+		maxPause time.Duration
+		parts    []int
+	}{
+		{"disabled", []int{0, 10, 1000, 1010}, 0, []int{4}},
+		{"no pause", []int{0, 10, 20, 30}, time.Minute, []int{4}},
+		{"one pause", []int{0, 10, 1000, 1010}, time.Minute, []int{2, 2}},
+		{"two pauses", []int{0, 1000, 1010, 2000}, time.Minute, []int{1, 2, 1}},
+		// Exactly the maximum pause does not split
+		{"at the maximum", []int{0, 60, 120}, time.Minute, []int{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			points := make([]testPoint, 0, len(test.seconds))
+			for i, seconds := range test.seconds {
+				points = append(points, testPoint{lat: 51 + float64(i)*0.0005, lng: 3.7174, seconds: seconds})
+			}
+			parts := newTestTrack(t, points...).Split(test.maxPause)
+			if len(parts) != len(test.parts) {
+				t.Fatalf("%v parts, want %v", len(parts), len(test.parts))
+			}
+			for i, part := range parts {
+				if part.Len() != test.parts[i] {
+					t.Errorf("part %v has %v points, want %v", i, part.Len(), test.parts[i])
+				}
+			}
+		})
+	}
+}
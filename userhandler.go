@@ -1,18 +1,73 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"time"
 
 	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
 	log "github.com/sirupsen/logrus"
+
+	"go-strava-daemon/stravaclient"
+)
+
+// Delay before retrying the backfill of a user after an error, doubled on every failure
+const (
+	backfillRetryDelay    = time.Minute
+	backfillMaxRetryDelay = 6 * time.Hour
 )
 
-// HandleExpiringUsers : Handle users which are about to time out
-func HandleExpiringUsers() {
+// backfillRetry : Backoff of a user whose backfill failed
+type backfillRetry struct {
+	failures int
+	next     time.Time
+	// parkedToken : Access token Strava refused, the user is skipped until the token is refreshed
+	parkedToken string
+}
+
+// backfillRetries : Failed backfills by user ID, only used by HandleNewUsers
+var backfillRetries = map[string]*backfillRetry{}
+
+// backfillDue : Check whether the backfill of a user may run, a refreshed token ends the parking of a user
+func backfillDue(user *dbmodel.User) bool {
+	retry, ok := backfillRetries[user.ID]
+	if !ok {
+		return true
+	} else if retry.parkedToken != "" {
+		if retry.parkedToken == user.AccessToken {
+			return false
+		}
+		delete(backfillRetries, user.ID)
+		return true
+	}
+	return !time.Now().Before(retry.next)
+}
+
+// backfillFailed : Park a user whose token was refused or back off after other errors, returns the log message
+func backfillFailed(user *dbmodel.User, err error) string {
+	if stravaclient.IsUnauthorized(err) {
+		backfillRetries[user.ID] = &backfillRetry{parkedToken: user.AccessToken}
+		return fmt.Sprintf("Strava refused the access token of user %v, the backfill resumes once the token is refreshed: %v", user.ID, err)
+	}
+
+	retry, ok := backfillRetries[user.ID]
+	if !ok {
+		retry = &backfillRetry{}
+		backfillRetries[user.ID] = retry
+	}
+	delay := backfillRetryDelay << uint(retry.failures)
+	if delay > backfillMaxRetryDelay || delay <= 0 {
+		delay = backfillMaxRetryDelay
+	}
+	retry.failures++
+	retry.next = time.Now().Add(delay)
+	return fmt.Sprintf("Backfill of user %v paused, retrying in %v: %v", user.ID, delay, err)
+}
+
+// HandleExpiringUsers : Handle users which are about to time out, until ctx is cancelled
+func HandleExpiringUsers(ctx context.Context) {
 	for {
+		loopStarted("expiring_users")
 		// Load expiring users
 		users, err := db.GetExpiringUsers()
 		if err != nil {
@@ -21,117 +76,164 @@ func HandleExpiringUsers() {
 
 		// Handle expiring users
 		for _, user := range users {
-			newUser, err := out.RefreshUserSubscription(&user)
+			if ctx.Err() != nil {
+				return
+			}
+			logger := log.WithFields(log.Fields{"user_id": user.ID, "owner_id": user.ProviderUser})
+			newUser, err := out.RefreshUserSubscription(inFlight, &user)
 			if err != nil {
-				log.Warnf("Could not refresh user subscription: %v", err)
+				tokenRefreshes.WithLabelValues("failure").Inc()
+				logger.Warnf("Could not refresh user subscription: %v", err)
+				continue
 			}
+			tokenRefreshes.WithLabelValues("success").Inc()
 
 			if err = db.UpdateUser(&newUser); err != nil {
-				log.Warnf("Could not update user: %v", err)
+				logger.Warnf("Could not update user: %v", err)
 			}
 		}
 
 		// Loop every 10 minutes
-		time.Sleep(10 * time.Minute)
+		loopFinished("expiring_users", 10*time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Minute):
+		}
 	}
 }
 
-// HandleNewUsers : Handle the registration of a new user
-func HandleNewUsers() {
+// HandleNewUsers : Handle the registration of a new user, until ctx is cancelled
+func HandleNewUsers(ctx context.Context) {
 	for {
+		loopStarted("new_users")
 		if users, err := db.FetchNewUsers(); err != nil {
 			log.Warnf("Could not fetch new users: %v", err)
 		} else {
+			backfillUsers.WithLabelValues("waiting").Set(float64(len(users)))
 			// Check if there are any users to process
 			if len(users) > 0 {
 				log.Infof("Fetching Strava activities for %v new users", len(users))
 
 				// Iterate over new users
-				for _, user := range users {
-					if err := FetchNewUserActivities(&user); err != nil {
-						log.Errorf("Could not store new user activities: %v", err)
-					} else {
-						log.Infof("Fetching user activities for user %v was successfull", user.ID)
+				for i, user := range users {
+					if ctx.Err() != nil {
+						return
+					}
+					backfillUsers.WithLabelValues("waiting").Set(float64(len(users) - i - 1))
+					if !backfillDue(&user) {
+						continue
 					}
-					user.IsHistoryFetched = true
-					if err := db.UpdateUser(&user); err != nil {
-						log.Errorf("Something went wrong updating the user: %v", err)
+					backfillUsers.WithLabelValues("running").Set(1)
+					logger := log.WithFields(log.Fields{"user_id": user.ID, "owner_id": user.ProviderUser})
+					complete, err := FetchNewUserActivities(ctx, &user)
+					backfillUsers.WithLabelValues("running").Set(0)
+					if err != nil && ctx.Err() == nil {
+						logger.Warn(backfillFailed(&user, err))
+					} else if err != nil {
+						logger.Warnf("Backfill of user %v paused, it resumes on the next start: %v", user.ID, err)
+					}
+					if !complete {
+						continue
+					}
+					delete(backfillRetries, user.ID)
+
+					logger.Infof("Fetching user activities for user %v was successfull", user.ID)
+					backfillUsersCompleted.Inc()
+					if err := db.MarkHistoryFetched(user.ID); err != nil {
+						logger.Errorf("Something went wrong updating the user: %v", err)
 					}
 				}
 
 			}
 		}
 
-		// Loop every 10 minutes
-		time.Sleep(10 * time.Second)
+		// Loop every 10 seconds
+		loopFinished("new_users", 10*time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
-// FetchNewUserActivities : Handle storing "old" activities of a new user
-func FetchNewUserActivities(user *dbmodel.User) error {
-	// Fetch activities for user
-	var activities []*StravaActivity
-	client := &http.Client{}
-
-	// Allow 20000 activities max
-	for page := 1; page < 100; page++ {
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/athlete/activities?per_page=%v&page=%v", MaxActivities, page), nil)
-		if err != nil {
-			return fmt.Errorf("Could not get user activities: %v", err)
-		}
-
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", user.AccessToken))
+// FetchNewUserActivities : Store the "old" activities of a new user, newest first, resuming from the stored cursor
+// Cancelling ctx stops the backfill after the current activity, its requests are only aborted with inFlight
+func FetchNewUserActivities(ctx context.Context, user *dbmodel.User) (complete bool, err error) {
+	client := backfillClient
+	logger := log.WithFields(log.Fields{"user_id": user.ID, "owner_id": user.ProviderUser})
+
+	// Second after the start of the oldest activity handled so far, 0 when the backfill has not started yet
+	// Strava only lists activities starting before the cursor, so activities sharing the start second are listed again
+	before, err := db.GetBackfillCursor(user.ID)
+	if err != nil {
+		err = fmt.Errorf("Could not get backfill cursor: %v", err)
+		return
+	}
+	handled := map[int64]bool{}
+	page := 1
 
-		res, err := client.Do(req)
+	for {
+		activities, err := client.ListAthleteActivities(inFlight, user.AccessToken, stravaclient.ListOptions{
+			Page:    page,
+			PerPage: MaxActivities,
+			Before:  before,
+		})
 		if err != nil {
-			return fmt.Errorf("Could not make request: %v", err)
+			return false, fmt.Errorf("Could not fetch user activities: %w", err)
 		}
 
-		// Except HTTP 429: too many requests
-		if res.StatusCode == 429 {
-			log.Warnf("Strava request limit has been reached - storing in database what we have")
-			break
+		// Reached the first activity of the user
+		if len(activities) == 0 {
+			return true, nil
 		}
-		defer res.Body.Close()
+		logger.Infof("Fetching %v activities from strava user %v", len(activities), user.ProviderUser)
+		backfillActivities.WithLabelValues("listed").Add(float64(len(activities)))
 
-		// Attempt to decode response
-		var tmpAct []*StravaActivity
-		err = json.NewDecoder(res.Body).Decode(&tmpAct)
-		if err != nil || len(tmpAct) < 1 {
-			return fmt.Errorf("Could not fetch user activities: %v", err)
-		}
-
-		// Add to global array
-		for _, act := range tmpAct {
-			activities = append(activities, act)
-		}
+		progressed := false
+		for _, summary := range activities {
+			if err := ctx.Err(); err != nil {
+				return false, fmt.Errorf("Backfill stopped: %v", err)
+			}
+			if handled[summary.ID] {
+				continue
+			}
+			progressed = true
+			act := &StravaActivity{Activity: summary, logEntry: logger.WithField("object_id", summary.ID)}
 
-		// Check if there's no more - should be if the len is 200
-		if len(tmpAct) < (200 * page) {
-			break
-		}
-	}
+			accepted, err := act.classify(user)
+			if err != nil {
+				return false, err
+			}
 
-	log.Infof("Fetching %v activities from strava user %v", len(activities), user.ProviderUser)
+			// Check for cycling type & convert activity to contribution
+			if accepted {
+				// Fetch the recorded streams, the polyline is used as fallback
+				if err := act.loadStreams(inFlight, client, user.AccessToken); err != nil {
+					return false, err
+				}
 
-	// Write activities to database
-	for _, act := range activities {
-		// Check for cycling type & convert activity to contribution
-		if act.Type == "Ride" && act.WorkoutType == 10 {
-			contrib, err := act.ConvertToContribution()
-			if err != nil {
-				log.Warnf("Could not convert activity to contribution: %v", err)
+				// Stop on storage errors so the activity is retried on the next run
+				if err := storeActivity(act, user); err != nil {
+					return false, err
+				}
 			}
 
-			// Get contribution in database
-			err = db.AddContribution(&contrib, user)
-			if err != nil {
-				log.Warnf("Could not upload contribution to database: %v", err)
-			} else {
-				log.Infof("Added contribution to database")
+			// Move the cursor to the handled activity, saving an activity again after a restart does no harm
+			handled[summary.ID] = true
+			before = act.StartDate.Unix() + 1
+			if err := db.SaveBackfillCursor(user.ID, before); err != nil {
+				return false, fmt.Errorf("Could not save backfill cursor: %v", err)
 			}
+			backfillActivities.WithLabelValues("handled").Inc()
 		}
-	}
 
-	return nil
+		// Only activities handled in this run were listed, look at the next page before the same cursor
+		if progressed {
+			page = 1
+		} else {
+			page++
+		}
+	}
 }
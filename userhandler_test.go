@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bikedataproject/go-bike-data-lib/dbmodel"
+
+	"go-strava-daemon/stravaclient"
+)
+
+func TestBackfillParksRefusedToken(t *testing.T) {
+	backfillRetries = map[string]*backfillRetry{}
+	user := dbmodel.User{ID: "1", AccessToken: "revoked"}
+
+	err := fmt.Errorf("Could not fetch user activities: %w", &stravaclient.APIError{StatusCode: http.StatusUnauthorized})
+	backfillFailed(&user, err)
+	if backfillDue(&user) {
+		t.Fatal("user with a refused token is not parked")
+	}
+
+	// A refreshed token ends the parking
+	user.AccessToken = "refreshed"
+	if !backfillDue(&user) {
+		t.Fatal("user with a refreshed token is still parked")
+	}
+	if _, ok := backfillRetries[user.ID]; ok {
+		t.Fatal("parking not cleared after the token was refreshed")
+	}
+}
+
+func TestBackfillBacksOff(t *testing.T) {
+	backfillRetries = map[string]*backfillRetry{}
+	user := dbmodel.User{ID: "1", AccessToken: "valid"}
+	err := &stravaclient.APIError{StatusCode: http.StatusInternalServerError}
+
+	delays := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for _, delay := range delays {
+		before := time.Now()
+		backfillFailed(&user, err)
+		if backfillDue(&user) {
+			t.Fatalf("user is due right after a failure")
+		}
+		if next := backfillRetries[user.ID].next.Sub(before); next < delay || next > delay+time.Second {
+			t.Errorf("retry after %v, want %v", next, delay)
+		}
+	}
+
+	// The delay is capped
+	for i := 0; i < 20; i++ {
+		backfillFailed(&user, err)
+	}
+	if next := time.Until(backfillRetries[user.ID].next); next > backfillMaxRetryDelay {
+		t.Errorf("retry after %v, want at most %v", next, backfillMaxRetryDelay)
+	}
+
+	// Due again once the delay passed
+	backfillRetries[user.ID].next = time.Now().Add(-time.Second)
+	if !backfillDue(&user) {
+		t.Error("user not due after the delay")
+	}
+}
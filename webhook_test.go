@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-strava-daemon/queue"
+	"go-strava-daemon/storage"
+	"go-strava-daemon/stravaclient"
+	"go-strava-daemon/stravafake"
+	"go-strava-daemon/track"
+)
+
+// testAthlete : Athlete of the example fixtures
+const testAthlete = 12345
+
+// testDaemon : Daemon wired to a fake Strava API and the memory storage
+type testDaemon struct {
+	fake     *stravafake.Server
+	memory   *storage.Memory
+	fixtures stravafake.Fixtures
+
+	mu sync.Mutex
+	// requests : Paths requested from the fake Strava API
+	requests []string
+	// rateLimited : Paths answered with HTTP 429 on their next request
+	rateLimited map[string]bool
+	// failing : Paths answered with an HTTP status on their next request
+	failing map[string]int
+}
+
+// startTestDaemon : Configure the daemon like main does, against a fake Strava API, and subscribe to its webhook
+func startTestDaemon(t *testing.T) (d *testDaemon, remove func()) {
+	t.Helper()
+	fixtures, err := stravafake.LoadFixtures("stravafake/fixtures.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = &testDaemon{
+		fake:        stravafake.New("test", "secret", fixtures),
+		fixtures:    fixtures,
+		rateLimited: map[string]bool{},
+		failing:     map[string]int{},
+	}
+	api := httptest.NewServer(http.HandlerFunc(d.serveAPI))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook/strava", HandleStravaWebhook)
+	webhook := httptest.NewServer(mux)
+	dir, err := ioutil.TempDir("", "daemon")
+	remove = func() {
+		webhook.Close()
+		api.Close()
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		remove()
+		t.Fatal(err)
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	conf.DeploymentType = "test"
+	conf.Storage = "memory"
+	conf.DryRun = false
+	conf.StravaClientID = "test"
+	conf.StravaClientSecret = "secret"
+	conf.StravaAPIURL = api.URL
+	conf.StravaWebhookURL = ""
+	conf.StravaVerifyToken = "verify"
+	conf.CallbackURL = webhook.URL + "/webhook/strava"
+	if err := configure(conf); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	connectStrava(conf)
+	// The fake only answers 429 when told to, the limiter would hold every later request until the window resets
+	stravaClient.Limiter = nil
+	backfillClient.Limiter = nil
+	if err := openStorage(conf, fixtures); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	d.memory = db.(*storage.Memory)
+	if events, err = queue.Open(dir); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	if err := restoreSubscription(conf); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+
+	// Strava validates the callback before creating the subscription
+	if err := out.Reconcile(context.Background()); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	if err := saveSubscription(); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return d, remove
+}
+
+// serveAPI : Record the request and pass it to the fake, rate limiting it when requested
+func (d *testDaemon) serveAPI(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	d.requests = append(d.requests, r.URL.Path)
+	if d.rateLimited[r.URL.Path] {
+		delete(d.rateLimited, r.URL.Path)
+		d.fake.RateLimitNext(1)
+	}
+	status, failing := d.failing[r.URL.Path]
+	delete(d.failing, r.URL.Path)
+	d.mu.Unlock()
+	if failing {
+		w.WriteHeader(status)
+		return
+	}
+	d.fake.ServeHTTP(w, r)
+}
+
+// rateLimit : Answer the next request of a path with HTTP 429
+func (d *testDaemon) rateLimit(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rateLimited[path] = true
+}
+
+// fail : Answer the next request of a path with an HTTP status
+func (d *testDaemon) fail(path string, status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failing[path] = status
+}
+
+// requested : Count the requests of a path
+func (d *testDaemon) requested(path string) (n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, request := range d.requests {
+		if request == path {
+			n++
+		}
+	}
+	return
+}
+
+// send : Deliver a webhook event and process the queued entries
+func (d *testDaemon) send(t *testing.T, event stravafake.Event) {
+	t.Helper()
+	event.OwnerID = testAthlete
+	if err := d.fake.SendEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	processReady()
+}
+
+// activity : Copy of the example ride with another ID and start
+func (d *testDaemon) activity(id int64, start time.Time) stravafake.Activity {
+	activity := d.fixtures.Athletes[0].Activities[0]
+	activity.ID = id
+	activity.StartDate = start
+	activity.StartDateLocal = start
+	return activity
+}
+
+// contributions : Count the stored contributions of an activity
+func (d *testDaemon) contributions(activityID int64) (n int) {
+	for _, contribution := range d.memory.Contributions() {
+		if contribution.ActivityID == activityID {
+			n++
+		}
+	}
+	return
+}
+
+// processReady : Process the queue entries signalled so far, like the queue workers
+func processReady() {
+	for {
+		select {
+		case name := <-events.Ready():
+			processQueueEntry(name)
+		default:
+			return
+		}
+	}
+}
+
+func TestFakeStravaRefusedInProduction(t *testing.T) {
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.DeploymentType = "production"
+	conf.FakeStrava = true
+	if err := configure(conf); err == nil {
+		t.Error("fake Strava API accepted in production")
+	}
+
+	// Outside production the fake replaces the Strava credentials
+	conf.DeploymentType = "local"
+	conf.Storage = "memory"
+	conf.CallbackURL, conf.StravaClientID, conf.StravaClientSecret = "", "", ""
+	if err := configure(conf); err != nil {
+		t.Errorf("local run against the fake refused: %v", err)
+	}
+	conf.FakeStrava = false
+	if err := configure(conf); err == nil {
+		t.Error("local run without Strava credentials accepted")
+	}
+}
+
+func TestWebhookHandshake(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	subscriptions := d.fake.Subscriptions()
+	if len(subscriptions) != 1 || subscriptions[0].CallbackURL != out.CallbackURL || subscriptions[0].ID != out.SubscriptionID() {
+		t.Fatalf("subscriptions %+v, want one for %v", subscriptions, out.CallbackURL)
+	}
+	if stored, err := db.GetSubscription(out.CallbackURL); err != nil || stored.ID != out.SubscriptionID() || stored.VerifyToken != "verify" {
+		t.Errorf("stored subscription %+v (%v)", stored, err)
+	}
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"valid", url.Values{"hub.mode": {"subscribe"}, "hub.challenge": {"abc"}, "hub.verify_token": {"verify"}}, http.StatusOK},
+		{"wrong token", url.Values{"hub.mode": {"subscribe"}, "hub.challenge": {"abc"}, "hub.verify_token": {"guess"}}, http.StatusForbidden},
+		{"no challenge", url.Values{"hub.mode": {"subscribe"}, "hub.verify_token": {"verify"}}, http.StatusForbidden},
+		{"wrong mode", url.Values{"hub.mode": {"unsubscribe"}, "hub.challenge": {"abc"}, "hub.verify_token": {"verify"}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		response, err := http.Get(out.CallbackURL + "?" + test.query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		json.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("%v: HTTP %v, want %v", test.name, response.StatusCode, test.status)
+		}
+		if test.status == http.StatusOK && body["hub.challenge"] != "abc" {
+			t.Errorf("%v: response %v does not echo the challenge", test.name, body)
+		}
+	}
+
+	// Events of another subscription are refused
+	response, err := http.Post(out.CallbackURL, "application/json", strings.NewReader(`{"object_type":"activity","object_id":1001,"aspect_type":"create","owner_id":12345,"subscription_id":999}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("event of another subscription: HTTP %v, want %v", response.StatusCode, http.StatusForbidden)
+	}
+	if n, err := events.Pending(); err != nil || n != 0 {
+		t.Errorf("%v pending entries (%v), want none", n, err)
+	}
+}
+
+func TestWebhookActivityEvents(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "create"})
+	if n := d.contributions(1001); n == 0 {
+		t.Fatal("created ride was not stored")
+	}
+	for _, contribution := range d.memory.Contributions() {
+		if contribution.TimeSource != TimeSourceStreams {
+			t.Errorf("contribution stored with time source %q, want %q", contribution.TimeSource, TimeSourceStreams)
+		}
+	}
+
+	// A run is rejected
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1002, AspectType: "create"})
+	if rejections := d.memory.Rejections(); len(rejections) != 1 || rejections[0].ActivityID != 1002 {
+		t.Errorf("rejections %+v, want activity 1002", rejections)
+	}
+
+	// Irrelevant updates are ignored without fetching the activity
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "update", Updates: map[string]string{"title": "Commute"}})
+	if n := d.requested("/activities/1001"); n != 1 {
+		t.Errorf("activity fetched %v times, want once", n)
+	}
+
+	// Changing the type replaces the stored ride with a rejection
+	ride := d.fixtures.Athletes[0].Activities[0]
+	run := ride
+	run.Type = "Run"
+	if err := d.fake.AddActivity(testAthlete, run); err != nil {
+		t.Fatal(err)
+	}
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "update", Updates: map[string]string{"type": "Run"}})
+	if n := d.contributions(1001); n != 0 {
+		t.Errorf("%v contributions left after the ride became a run", n)
+	}
+
+	if err := d.fake.AddActivity(testAthlete, ride); err != nil {
+		t.Fatal(err)
+	}
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "update", Updates: map[string]string{"type": "Ride"}})
+	if n := d.contributions(1001); n == 0 {
+		t.Error("ride was not stored again after changing the type back")
+	}
+
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "delete"})
+	if n := d.contributions(1001); n != 0 {
+		t.Errorf("%v contributions left after deleting the activity", n)
+	}
+	if n, err := events.Pending(); err != nil || n != 0 {
+		t.Errorf("%v pending entries (%v), want none", n, err)
+	}
+}
+
+func TestStreamsFallback(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// A server error is retried instead of storing the polyline
+	d.fail("/activities/1001/streams", http.StatusInternalServerError)
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "create"})
+	if n := d.contributions(1001); n != 0 {
+		t.Errorf("%v contributions stored without the streams", n)
+	}
+	if n, err := events.Pending(); err != nil || n != 1 {
+		t.Errorf("%v pending entries (%v), want the failed event", n, err)
+	}
+	if dead, err := events.Dead(); err != nil || len(dead) != 0 {
+		t.Errorf("dead letters %v (%v), want none", dead, err)
+	}
+
+	// An activity without streams falls back to the polyline
+	ride := d.activity(1003, time.Date(2020, 7, 22, 7, 30, 0, 0, time.UTC))
+	ride.Streams = nil
+	if err := d.fake.AddActivity(testAthlete, ride); err != nil {
+		t.Fatal(err)
+	}
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1003, AspectType: "create"})
+	if d.contributions(1003) == 0 {
+		t.Fatal("ride without streams was not stored")
+	}
+	for _, contribution := range d.memory.Contributions() {
+		if contribution.TimeSource != TimeSourceInterpolated {
+			t.Errorf("contribution stored with time source %q, want %q", contribution.TimeSource, TimeSourceInterpolated)
+		}
+	}
+}
+
+func TestPrivacyZoneSplitsTrip(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// Keep every point outside the zone, the pieces on both sides of it are short
+	defer func(filter track.Privacy, min track.MinLength) { PrivacyFilter, MinTrackLength = filter, min }(PrivacyFilter, MinTrackLength)
+	PrivacyFilter = track.Privacy{}
+	MinTrackLength = track.MinLength{Points: 2}
+	user, err := db.GetUserData("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := track.Zone{Latitude: 51.0593, Longitude: 3.7244, Radius: 60}
+	d.memory.AddPrivacyZone(user.ID, zone)
+
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "create"})
+	contributions := d.memory.Contributions()
+	if len(contributions) != 2 {
+		t.Fatalf("%v contributions, want the trips before and after the zone", len(contributions))
+	}
+	for _, contribution := range contributions {
+		for _, point := range contribution.Contribution.PointsGeom.Points() {
+			if zone.Contains(&point) {
+				t.Errorf("point %v of the zone was stored", point)
+			}
+		}
+	}
+}
+
+func TestInterpolatedActivityIsNotSplit(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// A long ride without streams, its interpolated points are further apart than the split pause
+	ride := d.activity(1003, time.Date(2020, 7, 22, 7, 30, 0, 0, time.UTC))
+	ride.Streams = nil
+	ride.ElapsedTime = 12 * 3600
+	if err := d.fake.AddActivity(testAthlete, ride); err != nil {
+		t.Fatal(err)
+	}
+	defer func(stages []track.Stage) { CleaningStages = stages }(CleaningStages)
+	CleaningStages = nil
+
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1003, AspectType: "create"})
+	if n := d.contributions(1003); n != 1 {
+		t.Errorf("%v contributions, want the whole ride", n)
+	}
+}
+
+func TestWebhookDeauthorization(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1001, AspectType: "create"})
+	if n := d.contributions(1001); n == 0 {
+		t.Fatal("created ride was not stored")
+	}
+
+	// Other athlete updates are ignored
+	d.send(t, stravafake.Event{ObjectType: "athlete", ObjectID: testAthlete, AspectType: "update", Updates: map[string]string{"weight": "70"}})
+	if purges := d.memory.Purges(); len(purges) != 0 {
+		t.Fatalf("purged %+v on an update of the athlete", purges)
+	}
+
+	d.send(t, stravafake.Event{ObjectType: "athlete", ObjectID: testAthlete, AspectType: "update", Updates: map[string]string{"authorized": "false"}})
+	if purges := d.memory.Purges(); len(purges) != 1 || purges[0].Policy != DeauthorizationPolicy || purges[0].Contributions == 0 {
+		t.Errorf("purges %+v, want one of the stored contributions", purges)
+	}
+	if n := len(d.memory.Contributions()); n != 0 {
+		t.Errorf("%v contributions left after the deauthorization", n)
+	}
+	if user, err := db.GetUserData("12345"); err != nil || user.AccessToken != "" || user.RefreshToken != "" {
+		t.Errorf("tokens of the deauthorized user were kept (%v)", err)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// Expire the tokens of the athlete while the backfill is still pending
+	user, err := db.GetUserData("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken := user.AccessToken
+	user.ExpiresAt = int(time.Now().Unix())
+	if err := db.UpdateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		HandleExpiringUsers(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if user, err = db.GetUserData("12345"); err != nil {
+			t.Fatal(err)
+		} else if user.AccessToken != oldToken || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if d.requested("/oauth/token") != 1 {
+		t.Errorf("tokens refreshed %v times, want once", d.requested("/oauth/token"))
+	}
+	if user.AccessToken == oldToken || user.RefreshToken == "refresh-12345" || user.RefreshToken == "" {
+		t.Fatalf("tokens of the expired user were not refreshed: %+v", user)
+	}
+	if user.ExpiresAt <= int(time.Now().Add(30*time.Minute).Unix()) {
+		t.Errorf("refreshed tokens expire at %v", time.Unix(int64(user.ExpiresAt), 0))
+	}
+	if user.IsHistoryFetched {
+		t.Error("refreshing the tokens marked the pending backfill as done")
+	}
+
+	// Strava only accepts the stored token from now on
+	if _, err := stravaClient.ListAthleteActivities(context.Background(), user.AccessToken, stravaclient.ListOptions{Page: 1, PerPage: 1}); err != nil {
+		t.Errorf("refreshed access token refused: %v", err)
+	}
+	if _, err := stravaClient.ListAthleteActivities(context.Background(), oldToken, stravaclient.ListOptions{Page: 1, PerPage: 1}); !stravaclient.IsUnauthorized(err) {
+		t.Errorf("expired access token accepted (%v)", err)
+	}
+}
+
+func TestBackfillResumesAfterRateLimit(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// A newer ride without streams, its timestamps are interpolated
+	newer := d.activity(1003, time.Date(2020, 7, 22, 7, 30, 0, 0, time.UTC))
+	newer.Streams = nil
+	if err := d.fake.AddActivity(testAthlete, newer); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.GetUserData("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rate limit is hit after the newer ride was stored
+	d.rateLimit("/activities/1001/streams")
+	complete, err := FetchNewUserActivities(context.Background(), &user)
+	if complete || err == nil {
+		t.Fatalf("backfill completed (%v) despite the rate limit", err)
+	}
+	if d.contributions(1003) == 0 || d.contributions(1001) != 0 {
+		t.Fatalf("contributions %+v, want only activity 1003", d.memory.Contributions())
+	}
+	// The run between both rides was rejected before the rate limit
+	run := d.fixtures.Athletes[0].Activities[1]
+	if cursor, err := db.GetBackfillCursor(user.ID); err != nil || cursor != run.StartDate.Unix()+1 {
+		t.Errorf("cursor %v (%v), want the second after the start of activity %v", cursor, err, run.ID)
+	}
+
+	// The next run resumes at the cursor
+	complete, err = FetchNewUserActivities(context.Background(), &user)
+	if !complete || err != nil {
+		t.Fatalf("backfill did not complete: %v", err)
+	}
+	if d.contributions(1001) == 0 {
+		t.Error("ride 1001 was not stored after resuming")
+	}
+	if n := d.requested("/activities/1003/streams"); n != 1 {
+		t.Errorf("streams of activity 1003 fetched %v times, want once", n)
+	}
+	for _, contribution := range d.memory.Contributions() {
+		if want := map[int64]string{1001: TimeSourceStreams, 1003: TimeSourceInterpolated}[contribution.ActivityID]; contribution.TimeSource != want {
+			t.Errorf("activity %v stored with time source %q, want %q", contribution.ActivityID, contribution.TimeSource, want)
+		}
+	}
+}
+
+func TestBackfillKeepsActivitiesSharingAStart(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// A second ride starting in the same second as ride 1001, listed one activity per page
+	ride := d.fixtures.Athletes[0].Activities[0]
+	if err := d.fake.AddActivity(testAthlete, d.activity(1004, ride.StartDate)); err != nil {
+		t.Fatal(err)
+	}
+	defer func(max int) { MaxActivities = max }(MaxActivities)
+	MaxActivities = 1
+
+	user, err := db.GetUserData("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, err := FetchNewUserActivities(context.Background(), &user)
+	if !complete || err != nil {
+		t.Fatalf("backfill did not complete: %v", err)
+	}
+	if d.contributions(1001) == 0 || d.contributions(1004) == 0 {
+		t.Errorf("contributions %+v, want both rides", d.memory.Contributions())
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	d, remove := startTestDaemon(t)
+	defer remove()
+
+	// The activity is not known to Strava yet, which is not retried
+	d.send(t, stravafake.Event{ObjectType: "activity", ObjectID: 1003, AspectType: "create"})
+	dead, err := events.Dead()
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("dead letters %v (%v), want one", dead, err)
+	}
+	if entry, err := events.ReadDead(dead[0]); err != nil || entry.LastError == "" {
+		t.Errorf("dead letter %+v (%v) without its error", entry, err)
+	}
+
+	if err := d.fake.AddActivity(testAthlete, d.activity(1003, time.Date(2020, 7, 22, 7, 30, 0, 0, time.UTC))); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Requeue(dead[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The daemon picks up requeued entries on its next sweep
+	if err := events.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	processReady()
+	if d.contributions(1003) == 0 {
+		t.Error("replayed event was not stored")
+	}
+	if dead, err := events.Dead(); err != nil || len(dead) != 0 {
+		t.Errorf("dead letters %v (%v) after the replay, want none", dead, err)
+	}
+}